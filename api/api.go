@@ -1,65 +1,592 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
-	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/discordianfish/infisk8-server/manager"
+	"github.com/discordianfish/infisk8-server/tracing"
 	"github.com/go-kit/kit/log"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/go-kit/kit/log/level"
 	"github.com/julienschmidt/httprouter"
+	"github.com/pion/webrtc/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/netutil"
+)
+
+const (
+	sdMaxLen       = 10240
+	metadataMaxLen = 256
+
+	// sessionSecretHeader carries the secret authorizing requests for an
+	// existing session.
+	sessionSecretHeader = "X-Session-Secret"
+	secretLen           = 32
 )
 
+// ACME challenge types.
 const (
-	sdMaxLen = 10240
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+)
+
+var (
+	startTimeGauge    prometheus.Gauge
+	joinErrorsCounter *prometheus.CounterVec
 )
 
+func init() {
+	SetMetricsNamespace("infisk8", "")
+}
+
+// SetMetricsNamespace replaces the metrics of the package by ones with the
+// given Prometheus namespace and subsystem. It must be called before New.
+func SetMetricsNamespace(namespace, subsystem string) {
+	if startTimeGauge != nil {
+		prometheus.Unregister(startTimeGauge)
+		prometheus.Unregister(joinErrorsCounter)
+	}
+	startTimeGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "start_time_seconds",
+		Help:      "Start time of the server since unix epoch in seconds",
+	})
+	joinErrorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "join_errors_total",
+		Help:      "Total number of failed joins, ICE restarts and renegotiations by the stage they failed in",
+	}, []string{"stage"})
+	prometheus.MustRegister(startTimeGauge)
+	prometheus.MustRegister(joinErrorsCounter)
+}
+
+// Config holds the HTTP server settings of the API.
+type Config struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// CORSOrigins are the origins allowed to access the API. If empty, all
+	// origins are allowed.
+	CORSOrigins []string
+
+	// TrustedProxies are the networks of proxies whose X-Forwarded-For and
+	// X-Real-IP headers are used to determine the client IP.
+	TrustedProxies []*net.IPNet
+
+	// MaxOfferSize is the maximum size in bytes of the base64 encoded offer
+	// in a join request. Zero uses the default of 10KB.
+	MaxOfferSize int
+
+	// AllowedNets and DeniedNets restrict access to the API by client IP.
+	// DeniedNets take precedence, an empty AllowedNets allows all IPs not
+	// denied.
+	AllowedNets []*net.IPNet
+	DeniedNets  []*net.IPNet
+
+	// JoinRate limits the rate of create and join requests per client IP
+	// and second, allowing bursts of JoinBurst requests. Zero disables rate
+	// limiting. The limiter tracks at most RateLimitSize IPs.
+	JoinRate      float64
+	JoinBurst     int
+	RateLimitSize int
+
+	BuildInfo BuildInfo
+
+	// StartTime is when the server got started. If zero, the time the API
+	// gets created is used.
+	StartTime time.Time
+
+	// MetricsPath is the path metrics are served on, /metrics if empty. If
+	// MetricsUsername or MetricsPassword is set, the metrics require basic
+	// auth.
+	MetricsPath     string
+	MetricsUsername string
+	MetricsPassword string
+
+	// AdminAPIKey is the bearer token required by the admin endpoints. If
+	// empty, the admin endpoints are disabled.
+	AdminAPIKey string
+
+	// AccessLog enables logging every request at info level.
+	AccessLog bool
+
+	// AdminAddr is the address the admin listener serves metrics, health
+	// and pprof on. If empty, they're served by the API listeners.
+	AdminAddr string
+
+	// EnablePprof registers the pprof handlers under /debug/pprof/. They
+	// shouldn't be reachable from the internet.
+	EnablePprof bool
+
+	// Network is the network TCP listeners listen on: tcp4 or tcp6 to bind
+	// IPv4 or IPv6 only. Defaults to tcp, which is dual-stack for
+	// unspecified addresses like :9000 or [::]:9000.
+	Network string
+
+	// CertFile and KeyFile are the certificate and key served by the TLS
+	// listener. If empty, certificates are requested via ACME.
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile is a PEM bundle of the CAs client certificates are
+	// verified against, using ClientAuth. ClientAuth defaults to requiring a
+	// verified client certificate if ClientCAFile is set.
+	ClientCAFile string
+	ClientAuth   tls.ClientAuthType
+
+	// H2C enables HTTP/2 without TLS on the plain listeners.
+	H2C bool
+
+	// DisableMetrics stops serving metrics on MetricsPath.
+	DisableMetrics bool
+
+	// ACMEChallenge is the challenge type used to request certificates via
+	// ACME, ChallengeHTTP01 by default or ChallengeTLSALPN01.
+	ACMEChallenge string
+
+	// MaxConns limits the concurrent connections of each API listener.
+	// Further connections wait to be accepted. Zero means unlimited.
+	MaxConns int
+}
+
+// BuildInfo describes the running build.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+}
+
 type API struct {
 	logger  log.Logger
 	manager *manager.Manager
 	handler http.Handler
-	acm     *autocert.Manager
+	admin   http.Handler      // nil if no admin listener is configured
+	acm     *autocert.Manager // nil if ACME isn't used
+	config  Config
+	limiter *rateLimiter  // nil if disabled
+	certs   *certReloader // nil if using ACME
 }
 
-func New(logger log.Logger, manager *manager.Manager, acm *autocert.Manager) *API {
+func New(logger log.Logger, manager *manager.Manager, acm *autocert.Manager, config Config) *API {
 	a := &API{
 		logger:  logger,
 		manager: manager,
 		acm:     acm,
+		config:  config,
+	}
+
+	if a.config.StartTime.IsZero() {
+		a.config.StartTime = time.Now()
+	}
+	startTimeGauge.Set(float64(a.config.StartTime.Unix()))
+	if a.config.MaxOfferSize <= 0 {
+		a.config.MaxOfferSize = sdMaxLen
+	}
+	if config.CertFile != "" {
+		a.certs = &certReloader{certFile: config.CertFile, keyFile: config.KeyFile}
+	}
+	if config.JoinRate > 0 {
+		a.limiter = newRateLimiter(config.JoinRate, config.JoinBurst, config.RateLimitSize)
 	}
 
 	router := httprouter.New()
+	router.GET("/version", a.HandleVersion)
 	router.GET("/pools", a.HandlePools)
-	router.PUT("/pool/:pool", a.HandleCreate)
-	router.POST("/pool/:pool/join/:id", a.HandleJoin)
-	router.Handler("GET", "/metrics", promhttp.Handler())
-	a.handler = a.acm.HTTPHandler(cors.Default().Handler(router))
+	router.GET("/pool/:pool/info", a.HandlePoolInfo)
+	router.PUT("/pool/:pool", a.rateLimit(a.HandleCreate))
+	router.GET("/pool/:pool/queue", a.HandleQueue)
+	router.POST("/pool/:pool/join", a.rateLimit(a.HandleJoin))
+	router.POST("/pool/:pool/join/:id", a.rateLimit(a.HandleJoin))
+	router.POST("/pool/:pool/session/:id/restart", a.rateLimit(a.HandleRestart))
+	router.POST("/pool/:pool/session/:id/offer", a.rateLimit(a.HandleRenegotiate))
+	if config.AdminAPIKey != "" {
+		router.POST("/pool/:pool/broadcast", a.requireAPIKey(a.HandleBroadcast))
+		router.POST("/pool/:pool/session/:id/kick", a.requireAPIKey(a.HandleKick))
+		router.POST("/pool/:pool/close-idle", a.requireAPIKey(a.HandleCloseIdle))
+		router.GET("/admin/sessions", a.requireAPIKey(a.HandleSessions))
+		router.POST("/admin/drain", a.requireAPIKey(a.HandleDrain))
+		router.POST("/admin/flush", a.requireAPIKey(a.HandleFlush))
+	}
+
+	ops := router
+	if config.AdminAddr != "" {
+		ops = httprouter.New()
+		a.admin = a.recoverHandler(ops)
+	}
+	ops.GET("/healthz", a.HandleHealth)
+	ops.GET("/ready", a.HandleReady)
+	if !config.DisableMetrics {
+		ops.Handler("GET", a.metricsPath(), a.metricsHandler())
+	}
+	if config.EnablePprof {
+		ops.GET("/debug/pprof/*item", handlePprof)
+		ops.POST("/debug/pprof/*item", handlePprof)
+		ops.GET("/debug/vars", a.HandleDebugVars)
+	}
+	// No origins allow all of them.
+	c := cors.New(cors.Options{
+		AllowedOrigins: config.CORSOrigins,
+		AllowedMethods: []string{http.MethodHead, http.MethodGet, http.MethodPost, http.MethodPut},
+		AllowedHeaders: []string{"Accept", "Content-Type", sessionSecretHeader, "traceparent"},
+		ExposedHeaders: []string{"X-Session-Id", sessionSecretHeader, "Retry-After"},
+	})
+	handler := a.recoverHandler(a.filterIPs(router))
+	if config.AccessLog {
+		handler = a.accessLog(handler)
+	}
+	a.handler = c.Handler(handler)
+	if a.acm != nil && config.ACMEChallenge != ChallengeTLSALPN01 {
+		a.handler = a.acm.HTTPHandler(a.handler)
+	}
 	return a
 }
 
+func (a *API) metricsPath() string {
+	if a.config.MetricsPath == "" {
+		return "/metrics"
+	}
+	return a.config.MetricsPath
+}
+
+func (a *API) metricsHandler() http.Handler {
+	h := promhttp.Handler()
+	if a.config.MetricsUsername == "" && a.config.MetricsPassword == "" {
+		return h
+	}
+	return basicAuth(a.config.MetricsUsername, a.config.MetricsPassword, h)
+}
+
+// recoverHandler recovers from panics in next, logs them and responds with
+// 500 Internal Server Error.
+func (a *API) recoverHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				level.Error(a.logger).Log("msg", "Recovered from panic", "panic", err, "path", r.URL.Path, "stack", string(debug.Stack()))
+				writeJSONError(w, http.StatusInternalServerError, "internal_error", "Internal Server Error")
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newServer returns a http.Server for addr serving handler with the
+// configured timeouts.
+func (a *API) newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: a.config.ReadHeaderTimeout,
+		ReadTimeout:       a.config.ReadTimeout,
+		WriteTimeout:      a.config.WriteTimeout,
+		IdleTimeout:       a.config.IdleTimeout,
+	}
+}
+
+// ServeHTTP serves the API on the main router, including the ops endpoints
+// unless an admin address is configured.
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.handler.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves the API on addr. Addresses of the form
+// unix:/path/to/socket listen on a Unix domain socket, anything else on TCP.
 func (a *API) ListenAndServe(addr string) error {
-	level.Info(a.logger).Log("msg", "Listening", "addr", addr, "proto", "http")
-	return http.ListenAndServe(addr, a.handler)
+	return a.serve(addr, a.handler, a.config.MaxConns)
+}
+
+// ListenAndServeAdmin serves metrics, health and pprof on the configured
+// AdminAddr.
+func (a *API) ListenAndServeAdmin() error {
+	if a.admin == nil {
+		return fmt.Errorf("No admin address configured")
+	}
+	return a.serve(a.config.AdminAddr, a.admin, 0)
+}
+
+// serve serves handler on addr, accepting up to maxConns concurrent
+// connections unless maxConns is zero.
+func (a *API) serve(addr string, handler http.Handler, maxConns int) error {
+	if a.config.H2C {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		ln, err := listenUnix(path)
+		if err != nil {
+			return err
+		}
+		level.Info(a.logger).Log("msg", "Listening", "addr", path, "proto", "http+unix")
+		return a.newServer(addr, handler).Serve(limitListener(ln, maxConns))
+	}
+	ln, err := net.Listen(a.network(), addr)
+	if err != nil {
+		return err
+	}
+	level.Info(a.logger).Log("msg", "Listening", "addr", ln.Addr(), "network", a.network(), "proto", "http")
+	return a.newServer(addr, handler).Serve(limitListener(ln, maxConns))
+}
+
+// limitListener limits ln to n concurrent connections, further ones wait to
+// be accepted. Zero means unlimited.
+func limitListener(ln net.Listener, n int) net.Listener {
+	if n <= 0 {
+		return ln
+	}
+	return netutil.LimitListener(ln, n)
+}
+
+func (a *API) network() string {
+	if a.config.Network == "" {
+		return "tcp"
+	}
+	return a.config.Network
+}
+
+// listenUnix listens on the Unix domain socket path, removing a stale socket
+// left behind by a previous process first. The socket is made accessible to
+// the owner and group only.
+func listenUnix(path string) (net.Listener, error) {
+	fi, err := os.Stat(path)
+	switch {
+	case err == nil && fi.Mode()&os.ModeSocket == 0:
+		return nil, fmt.Errorf("Couldn't listen on %s: file exists and isn't a socket", path)
+	case err == nil:
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("Couldn't remove stale socket: %w", err)
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
 }
 
 func (a *API) ListenAndServeTLS(addr string) error {
 	tlsConfig := &tls.Config{
-		GetCertificate: a.acm.GetCertificate,
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	switch {
+	case a.certs != nil:
+		if err := a.certs.load(); err != nil {
+			return err
+		}
+		tlsConfig.GetCertificate = a.certs.GetCertificate
+	case a.acm != nil:
+		tlsConfig.GetCertificate = a.acm.GetCertificate
+		if a.config.ACMEChallenge == ChallengeTLSALPN01 {
+			tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
+		}
+	default:
+		return fmt.Errorf("No certificate files or ACME configured")
 	}
-	ln, err := tls.Listen("tcp", addr, tlsConfig)
+	if a.config.ClientCAFile != "" {
+		pool, err := loadCertPool(a.config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = a.config.ClientAuth
+		if tlsConfig.ClientAuth == tls.NoClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	// Limit the raw connections and wrap the limited listener in TLS, so the
+	// server still gets *tls.Conn for HTTP/2 and r.TLS.
+	ln, err := net.Listen(a.network(), addr)
 	if err != nil {
 		return err
 	}
-	server := &http.Server{Addr: addr, Handler: a.handler}
-	level.Info(a.logger).Log("msg", "Listening", "addr", addr, "proto", "https")
-	return server.Serve(ln)
+	server := a.newServer(addr, a.handler)
+	level.Info(a.logger).Log("msg", "Listening", "addr", ln.Addr(), "network", a.network(), "proto", "https")
+	return server.Serve(tls.NewListener(limitListener(ln, a.config.MaxConns), tlsConfig))
+}
+
+type debugVars struct {
+	Pools           []manager.PoolInfo `json:"pools"`
+	Sessions        int                `json:"sessions"`
+	MessagesRelayed uint64             `json:"messagesRelayed"`
+	Goroutines      int                `json:"goroutines"`
+}
+
+// HandleDebugVars responds with a snapshot of the pools hosted by this node,
+// their sessions and messages and the number of goroutines.
+func (a *API) HandleDebugVars(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	vars := debugVars{
+		Pools:      a.manager.PoolInfos(),
+		Goroutines: runtime.NumGoroutine(),
+	}
+	for _, p := range vars.Pools {
+		vars.Sessions += p.Sessions
+		vars.MessagesRelayed += p.MessagesRelayed
+	}
+	a.writeJSON(w, vars)
+}
+
+func handlePprof(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	switch ps.ByName("item") {
+	case "/cmdline":
+		pprof.Cmdline(w, r)
+	case "/profile":
+		pprof.Profile(w, r)
+	case "/symbol":
+		pprof.Symbol(w, r)
+	case "/trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Index(w, r)
+	}
+}
+
+type errorResponse struct {
+	Error apiError `json:"error"`
+}
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeJSONError responds with status and an error body holding the machine
+// readable code and a human readable message.
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: apiError{Code: code, Message: message}})
+}
+
+// writeAnswer responds with answer as JSON or, if the request asks for it
+// with the encoding=base64 query parameter or by accepting text/plain, as
+// base64 encoded SDP mirroring the offer.
+func (a *API) writeAnswer(w http.ResponseWriter, r *http.Request, answer webrtc.SessionDescription) {
+	if r.URL.Query().Get("encoding") != "base64" && r.Header.Get("Accept") != "text/plain" {
+		a.writeJSON(w, answer)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	if _, err := io.WriteString(w, base64.StdEncoding.EncodeToString([]byte(answer.SDP))); err != nil {
+		level.Warn(a.logger).Log("msg", "Couldn't write answer", "error", err)
+	}
+}
+
+// writeOfferError responds with the error returned when answering an offer
+// and counts it as join error of stage sdp for invalid offers or session for
+// failures setting up the session.
+func (a *API) writeOfferError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, manager.ErrInvalidSecret) {
+		level.Info(a.logger).Log("msg", "Invalid session secret", "err", err, "client_ip", a.clientIP(r))
+		joinErrorsCounter.WithLabelValues("secret").Inc()
+		writeJSONError(w, http.StatusForbidden, "invalid_secret", "Missing or invalid session secret")
+		return
+	}
+	if errors.Is(err, manager.ErrInvalidOffer) {
+		level.Info(a.logger).Log("msg", "Invalid offer", "err", err, "client_ip", a.clientIP(r))
+		joinErrorsCounter.WithLabelValues("sdp").Inc()
+		writeJSONError(w, http.StatusBadRequest, "invalid_offer", err.Error())
+		return
+	}
+	joinErrorsCounter.WithLabelValues("session").Inc()
+	if errors.Is(err, context.Canceled) { // Client went away
+		level.Debug(a.logger).Log("msg", "Request cancelled while answering offer", "err", err)
+		return
+	}
+	level.Warn(a.logger).Log("msg", "Couldn't answer offer", "err", err, "client_ip", a.clientIP(r))
+	writeJSONError(w, http.StatusInternalServerError, "session_failed", "Couldn't set up session")
+}
+
+// writePoolError responds with the error returned when getting a pool from
+// the manager.
+func writePoolError(w http.ResponseWriter, err error) {
+	var rerr *manager.RemotePoolError
+	if errors.As(err, &rerr) {
+		writeJSONError(w, http.StatusMisdirectedRequest, "pool_on_other_node", rerr.Error())
+		return
+	}
+	writeJSONError(w, http.StatusNotFound, "pool_not_found", "Couldn't find pool")
+}
+
+// newSecret returns a random session secret.
+func newSecret() (string, error) {
+	b := make([]byte, secretLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// writeJSON responds with v encoded as JSON.
+func (a *API) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		level.Warn(a.logger).Log("msg", "Couldn't encode response", "error", err)
+	}
+}
+
+func (a *API) HandleHealth(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	fmt.Fprintln(w, "OK")
+}
+
+type versionResponse struct {
+	BuildInfo
+	StartTime time.Time `json:"startTime"`
+	Uptime    string    `json:"uptime"`
+}
+
+// HandleReady responds with 503 Service Unavailable while draining, so load
+// balancers stop sending new clients.
+func (a *API) HandleReady(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if a.manager.Draining() {
+		writeJSONError(w, http.StatusServiceUnavailable, "draining", "Draining, not accepting new sessions")
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+func (a *API) HandleVersion(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	a.writeJSON(w, versionResponse{
+		BuildInfo: a.config.BuildInfo,
+		StartTime: a.config.StartTime,
+		Uptime:    time.Since(a.config.StartTime).Round(time.Second).String(),
+	})
 }
 
 type poolsResponse struct {
@@ -67,7 +594,9 @@ type poolsResponse struct {
 }
 
 type Pool struct {
-	Name string `json:"name"`
+	Name     string `json:"name"`
+	Sessions int    `json:"sessions"`
+	Node     string `json:"node,omitempty"` // Set if hosted by another node
 }
 
 func (a *API) HandlePools(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -75,42 +604,345 @@ func (a *API) HandlePools(w http.ResponseWriter, r *http.Request, _ httprouter.P
 		Pools: []Pool{},
 	}
 	for _, pn := range a.manager.Pools() {
-		pr.Pools = append(pr.Pools, Pool{Name: pn})
+		pool, err := a.manager.Pool(pn)
+		var rerr *manager.RemotePoolError
+		if errors.As(err, &rerr) {
+			pr.Pools = append(pr.Pools, Pool{Name: pn, Node: rerr.Node})
+			continue
+		}
+		if err != nil { // Pool got removed in the meantime
+			continue
+		}
+		pr.Pools = append(pr.Pools, Pool{Name: pn, Sessions: pool.SessionCount()})
+	}
+	a.writeJSON(w, pr)
+}
+
+// HandlePoolInfo responds with information about a pool.
+func (a *API) HandlePoolInfo(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	pool, err := a.manager.Pool(ps.ByName("pool"))
+	if err != nil {
+		writePoolError(w, err)
+		return
 	}
-	json.NewEncoder(w).Encode(pr)
+	a.writeJSON(w, pool.Info())
 }
 
 func (a *API) HandleCreate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	pool, err := a.manager.NewPool(ps.ByName("pool"))
+	if a.manager.PoolExists(ps.ByName("pool")) {
+		writeJSONError(w, http.StatusConflict, "pool_exists", "Pool already exists")
+		return
+	}
+	var config manager.PoolConfig
+	if err := json.NewDecoder(io.LimitReader(r.Body, sdMaxLen)).Decode(&config); err != nil && err != io.EOF {
+		writeJSONError(w, http.StatusBadRequest, "invalid_pool_config", "Invalid pool config")
+		return
+	}
+	pool, err := a.manager.NewPool(ps.ByName("pool"), config)
 	if err != nil {
-		level.Warn(a.logger).Log("msg", "Couldn't create pool", "error", err)
-		http.Error(w, "Couldn't create pool", http.StatusInternalServerError)
+		switch {
+		case errors.Is(err, manager.ErrDraining):
+			writeJSONError(w, http.StatusServiceUnavailable, "draining", "Draining, not accepting new pools")
+		case errors.Is(err, manager.ErrTooManyPools):
+			writeJSONError(w, http.StatusServiceUnavailable, "too_many_pools", "Maximum number of pools reached")
+		case errors.Is(err, manager.ErrPoolExists): // Created since the check above
+			writeJSONError(w, http.StatusConflict, "pool_exists", "Pool already exists")
+		case errors.Is(err, manager.ErrInvalidPoolConfig):
+			writeJSONError(w, http.StatusBadRequest, "invalid_pool_config", err.Error())
+		case errors.Is(err, manager.ErrInvalidPoolName):
+			writeJSONError(w, http.StatusBadRequest, "invalid_pool_name", err.Error())
+		default:
+			level.Warn(a.logger).Log("msg", "Couldn't create pool", "error", err)
+			writeJSONError(w, http.StatusInternalServerError, "pool_create_failed", "Couldn't create pool")
+		}
+		return
+	}
+	a.writeJSON(w, pool)
+}
+
+// HandleQueue holds the request as server-sent event stream until a slot in
+// the pool opens, sending a slot-available event, or the client gets dropped
+// from the full queue, sending a dropped event. If the pool isn't full, the
+// event is sent right away. Note that a WriteTimeout ends waiting early.
+func (a *API) HandleQueue(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	pool, ok := a.manager.LocalPool(ps.ByName("pool"))
+	if !ok {
+		_, err := a.manager.Pool(ps.ByName("pool")) // Tells remote from unknown pools
+		writePoolError(w, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming_unsupported", "Streaming not supported")
+		return
+	}
+	ready, cancel := pool.WaitForSlot()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	select {
+	case <-r.Context().Done():
 		return
+	case ok := <-ready:
+		event := "slot-available"
+		if !ok {
+			event = "dropped"
+		}
+		fmt.Fprintf(w, "event: %s\ndata: {}\n\n", event)
+		flusher.Flush()
 	}
-	json.NewEncoder(w).Encode(pool)
 }
 
+// HandleJoin creates a session for the offer in the request body and responds
+// with the answer. If no session id is given, one gets generated. The id of
+// the session is returned in the X-Session-Id header and its secret in the
+// X-Session-Secret header. Rejoining an existing session requires sending its
+// secret in the X-Session-Secret header, the session keeps it then.
 func (a *API) HandleJoin(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	level.Debug(a.logger).Log("msg", r.Method, "path", r.URL.Path)
-	pool, err := a.manager.Pool(ps.ByName("pool"))
+	ctx, span := startSpan(r, "HandleJoin")
+	defer span.End()
+	span.SetAttributes(attribute.String("pool", ps.ByName("pool")))
+	pool, err := a.manager.JoinPool(ps.ByName("pool"))
+	tracing.SetError(span, err)
+	if errors.Is(err, manager.ErrDraining) {
+		writeJSONError(w, http.StatusServiceUnavailable, "draining", "Draining, not accepting new sessions")
+		return
+	}
 	if err != nil {
 		level.Warn(a.logger).Log("msg", "Couldn't join pool", "error", err)
-		http.Error(w, "Couldn't join pool", http.StatusInternalServerError)
+		writePoolError(w, err)
 		return
 	}
 
-	sd, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, &io.LimitedReader{R: r.Body, N: sdMaxLen}))
-	if err != nil {
-		level.Debug(a.logger).Log("msg", "Invalid base64", "err", err, "sd", sd)
-		http.Error(w, "Invalid base64", http.StatusBadRequest)
+	config := manager.SessionConfig{
+		ClientIP:   a.clientIP(r),
+		RemoteAddr: r.RemoteAddr,
+		TraceID:    traceID(span),
+		ClientCN:   clientCN(r),
+	}
+	if v := r.URL.Query().Get("spectator"); v != "" {
+		config.Spectator, err = strconv.ParseBool(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_parameter", "Invalid spectator parameter")
+			return
+		}
+	}
+	if md := r.URL.Query().Get("metadata"); md != "" {
+		if len(md) > metadataMaxLen || !utf8.ValidString(md) {
+			writeJSONError(w, http.StatusBadRequest, "invalid_metadata", fmt.Sprintf("Metadata must be valid UTF-8 of at most %d bytes", metadataMaxLen))
+			return
+		}
+		config.Metadata = md
+	}
+	if v := r.URL.Query().Get("compression"); v != "" {
+		config.Compression, err = strconv.ParseBool(v)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_parameter", "Invalid compression parameter")
+			return
+		}
+	}
+
+	sd, stage := a.readOffer(w, r)
+	if stage != "" {
+		joinErrorsCounter.WithLabelValues(stage).Inc()
 		return
 	}
 
-	answer, err := pool.NewSession(sd, ps.ByName("id"))
+	id := ps.ByName("id")
+	if id == "" {
+		id = a.manager.NewID()
+	}
+	config.Secret = r.Header.Get(sessionSecretHeader)
+	if config.Secret == "" {
+		if config.Secret, err = newSecret(); err != nil {
+			level.Error(a.logger).Log("msg", "Couldn't generate session secret", "err", err)
+			writeJSONError(w, http.StatusInternalServerError, "session_failed", "Couldn't set up session")
+			return
+		}
+	}
+	span.SetAttributes(attribute.String("session", id))
+	answer, err := pool.NewSession(ctx, sd, id, config)
+	tracing.SetError(span, err)
 	if err != nil {
 		level.Debug(a.logger).Log("msg", "Error creating session", "err", err, "sd", sd)
-		http.Error(w, "Invalid SD", http.StatusBadRequest)
+		if errors.Is(err, manager.ErrDraining) {
+			writeJSONError(w, http.StatusServiceUnavailable, "draining", err.Error())
+			return
+		}
+		if errors.Is(err, manager.ErrPoolFull) {
+			writeJSONError(w, http.StatusServiceUnavailable, "pool_full", err.Error())
+			return
+		}
+		a.writeOfferError(w, r, err)
+		return
+	}
+	w.Header().Set("X-Session-Id", id)
+	w.Header().Set(sessionSecretHeader, config.Secret)
+	a.writeAnswer(w, r, answer)
+}
+
+type broadcastRequest struct {
+	Label string `json:"label"`
+	Data  string `json:"data"`
+}
+
+// HandleBroadcast sends the data in the request body on the given label to
+// all sessions of the pool, e.g. for server announcements.
+func (a *API) HandleBroadcast(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx, span := startSpan(r, "HandleBroadcast")
+	defer span.End()
+	span.SetAttributes(attribute.String("pool", ps.ByName("pool")))
+	pool, err := a.manager.Pool(ps.ByName("pool"))
+	if err != nil {
+		writePoolError(w, err)
+		return
+	}
+	var br broadcastRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, sdMaxLen)).Decode(&br); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", "Invalid broadcast request")
+		return
+	}
+	if br.Label == "" {
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", "Missing label")
+		return
+	}
+	level.Info(a.logger).Log("msg", "Broadcasting announcement", "pool", ps.ByName("pool"), "label", br.Label)
+	pool.Broadcast(ctx, "", br.Label, []byte(br.Data))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type sessionsResponse struct {
+	Sessions []manager.SessionInfo `json:"sessions"`
+}
+
+// HandleSessions lists the sessions of all pools.
+func (a *API) HandleSessions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	a.writeJSON(w, sessionsResponse{Sessions: a.manager.Sessions()})
+}
+
+// HandleDrain stops accepting new pools and sessions.
+func (a *API) HandleDrain(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	a.manager.Drain()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleFlush closes all pools and sessions of this node, e.g. to get a clean
+// slate during tests or incidents. New pools can be created afterwards.
+func (a *API) HandleFlush(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	level.Warn(a.logger).Log("msg", "Flushing all pools on admin request", "client_ip", a.clientIP(r))
+	if err := a.manager.Flush(r.Context()); err != nil {
+		writeJSONError(w, http.StatusGatewayTimeout, "timeout", "Not all sessions got closed before the request ended")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleKick closes a session and notifies the other sessions of the pool.
+func (a *API) HandleKick(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	pool, err := a.manager.Pool(ps.ByName("pool"))
+	if err != nil {
+		writePoolError(w, err)
+		return
+	}
+	if err := pool.KickSession(ps.ByName("id")); err != nil {
+		if errors.Is(err, manager.ErrSessionNotFound) {
+			writeJSONError(w, http.StatusNotFound, "session_not_found", "Couldn't find session")
+			return
+		}
+		// The session got removed, only closing its connection failed.
+		level.Warn(a.logger).Log("msg", "Couldn't close kicked session", "error", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleCloseIdle closes all sessions of the pool which haven't sent a
+// message within the duration given by the idle query parameter.
+func (a *API) HandleCloseIdle(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	idle, err := time.ParseDuration(r.URL.Query().Get("idle"))
+	if err != nil || idle <= 0 {
+		writeJSONError(w, http.StatusBadRequest, "invalid_parameter", "Invalid idle parameter, must be a positive duration like 30s")
+		return
+	}
+	pool, err := a.manager.Pool(ps.ByName("pool"))
+	if err != nil {
+		writePoolError(w, err)
+		return
+	}
+	a.writeJSON(w, struct {
+		Closed int `json:"closed"`
+	}{pool.CloseIdle(idle)})
+}
+
+// HandleRestart answers an ICE restart offer for an existing session, e.g.
+// after the client changed networks. The session keeps its id and its place
+// in the pool. The request needs the session's secret in the
+// X-Session-Secret header.
+func (a *API) HandleRestart(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	a.handleSessionOffer(w, r, ps, "HandleRestart", (*manager.Pool).RestartSession)
+}
+
+// HandleRenegotiate answers a new offer for an existing session, e.g. after
+// the client added a datachannel. Like HandleRestart, it needs the session's
+// secret.
+func (a *API) HandleRenegotiate(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	a.handleSessionOffer(w, r, ps, "HandleRenegotiate", (*manager.Pool).RenegotiateSession)
+}
+
+// handleSessionOffer responds with the answer returned by f for the offer in
+// the body of r and the session given by ps, traced as span called name.
+func (a *API) handleSessionOffer(w http.ResponseWriter, r *http.Request, ps httprouter.Params, name string, f func(*manager.Pool, context.Context, string, string, []byte) (webrtc.SessionDescription, error)) {
+	ctx, span := startSpan(r, name)
+	defer span.End()
+	span.SetAttributes(attribute.String("pool", ps.ByName("pool")), attribute.String("session", ps.ByName("id")))
+	pool, err := a.manager.Pool(ps.ByName("pool"))
+	if err != nil {
+		writePoolError(w, err)
+		return
+	}
+	sd, stage := a.readOffer(w, r)
+	if stage != "" {
+		joinErrorsCounter.WithLabelValues(stage).Inc()
+		return
+	}
+	answer, err := f(pool, ctx, ps.ByName("id"), r.Header.Get(sessionSecretHeader), sd)
+	tracing.SetError(span, err)
+	if err != nil {
+		level.Debug(a.logger).Log("msg", "Couldn't answer offer", "err", err, "sd", sd)
+		if errors.Is(err, manager.ErrSessionNotFound) {
+			writeJSONError(w, http.StatusNotFound, "session_not_found", "Couldn't find session")
+			return
+		}
+		a.writeOfferError(w, r, err)
 		return
 	}
-	json.NewEncoder(w).Encode(answer)
+	a.writeAnswer(w, r, answer)
+}
+
+// readOffer reads the base64 encoded offer from the body of r. If that fails,
+// it responds with an error and returns the failed stage: body, size or
+// base64.
+func (a *API) readOffer(w http.ResponseWriter, r *http.Request) ([]byte, string) {
+	// Read one byte more than allowed to tell oversized offers apart.
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(a.config.MaxOfferSize)+1))
+	if err != nil {
+		level.Debug(a.logger).Log("msg", "Couldn't read body", "err", err)
+		writeJSONError(w, http.StatusBadRequest, "invalid_body", "Couldn't read body")
+		return nil, "body"
+	}
+	if len(body) > a.config.MaxOfferSize {
+		level.Info(a.logger).Log("msg", "Offer too large", "size", len(body), "client_ip", a.clientIP(r))
+		writeJSONError(w, http.StatusRequestEntityTooLarge, "offer_too_large", fmt.Sprintf("Offer exceeds maximum size of %d bytes", a.config.MaxOfferSize))
+		return nil, "size"
+	}
+	sd, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(body)))
+	if err != nil {
+		level.Info(a.logger).Log("msg", "Invalid base64", "err", err, "client_ip", a.clientIP(r))
+		writeJSONError(w, http.StatusBadRequest, "invalid_base64", "Invalid base64")
+		return nil, "base64"
+	}
+	return sd, ""
 }
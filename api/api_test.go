@@ -0,0 +1,484 @@
+package api_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/discordianfish/infisk8-server/api"
+	"github.com/discordianfish/infisk8-server/api/apitest"
+	"github.com/discordianfish/infisk8-server/manager"
+	"github.com/go-kit/kit/log"
+	"github.com/pion/webrtc/v3"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestHandleJoin(t *testing.T) {
+	server, m := apitest.NewServer(t, api.Config{MaxOfferSize: 16 << 10}, manager.WithICEServers(nil))
+	if _, err := m.NewPool("test", manager.PoolConfig{}); err != nil {
+		t.Fatalf("Couldn't create pool: %s", err)
+	}
+	_, offer := apitest.NewOffer(t, "game")
+	jsonOffer, err := json.Marshal(offer)
+	if err != nil {
+		t.Fatalf("Couldn't encode offer: %s", err)
+	}
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+	for _, tc := range []struct {
+		name   string
+		pool   string
+		body   string
+		status int
+		code   string
+	}{
+		{name: "sdp", pool: "test", body: encode(offer.SDP), status: http.StatusOK},
+		{name: "json", pool: "test", body: encode(string(jsonOffer)), status: http.StatusOK},
+		{name: "unknown pool", pool: "missing", body: encode(offer.SDP), status: http.StatusNotFound, code: "pool_not_found"},
+		{name: "invalid base64", pool: "test", body: "not base64!", status: http.StatusBadRequest, code: "invalid_base64"},
+		{name: "invalid sdp", pool: "test", body: encode("hello"), status: http.StatusBadRequest, code: "invalid_offer"},
+		{name: "answer instead of offer", pool: "test", body: encode(`{"type":"answer","sdp":"m=application"}`), status: http.StatusBadRequest, code: "invalid_offer"},
+		{name: "too large", pool: "test", body: strings.Repeat("A", 16<<10+1), status: http.StatusRequestEntityTooLarge, code: "offer_too_large"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := server.Client().Post(server.URL+"/pool/"+tc.pool+"/join", "text/plain", strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatalf("Couldn't join: %s", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.status {
+				t.Fatalf("Expected status %d, got %s", tc.status, resp.Status)
+			}
+			if tc.status != http.StatusOK {
+				var body struct {
+					Error struct {
+						Code string `json:"code"`
+					} `json:"error"`
+				}
+				if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+					t.Fatalf("Couldn't decode error: %s", err)
+				}
+				if body.Error.Code != tc.code {
+					t.Errorf("Expected error code %s, got %s", tc.code, body.Error.Code)
+				}
+				return
+			}
+			var answer webrtc.SessionDescription
+			if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+				t.Fatalf("Couldn't decode answer: %s", err)
+			}
+			if answer.Type != webrtc.SDPTypeAnswer || answer.SDP == "" {
+				t.Errorf("Expected an answer, got %+v", answer)
+			}
+			if resp.Header.Get("X-Session-Id") == "" {
+				t.Error("Missing X-Session-Id header")
+			}
+		})
+	}
+}
+
+func TestJoinOpensChannels(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		opened = map[string]bool{}
+	)
+	hooks := manager.SessionHooks{
+		OnChannelOpen: func(s *manager.Session, label string) {
+			mu.Lock()
+			opened[s.ID+"/"+label] = true
+			mu.Unlock()
+		},
+	}
+	server, m := apitest.NewServer(t, api.Config{}, manager.WithICEServers(nil), manager.WithSessionHooks(hooks))
+	if _, err := m.NewPool("test", manager.PoolConfig{}); err != nil {
+		t.Fatalf("Couldn't create pool: %s", err)
+	}
+	session := apitest.Join(t, server, "test", 10*time.Second, "game")
+	id := session.ID
+	if id == "" {
+		t.Fatal("Missing session id")
+	}
+	if session.Secret == "" {
+		t.Fatal("Missing session secret")
+	}
+	if _, ok := session.Channels["game"]; !ok {
+		t.Fatal("Missing game datachannel")
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		mu.Lock()
+		ok := opened[id+"/game"]
+		mu.Unlock()
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("OnChannelOpen wasn't called for the game datachannel")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandleSessionOffer(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		path    string
+		options *webrtc.OfferOptions
+	}{
+		{name: "renegotiate", path: "offer"},
+		{name: "restart", path: "restart", options: &webrtc.OfferOptions{ICERestart: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Renegotiating doesn't gather candidates again, so waiting for
+			// gathering to complete would block until the timeout.
+			server, m := apitest.NewServer(t, api.Config{}, manager.WithICEServers(nil), manager.WithGatheringTimeout(time.Minute))
+			if _, err := m.NewPool("test", manager.PoolConfig{}); err != nil {
+				t.Fatalf("Couldn't create pool: %s", err)
+			}
+			session := apitest.Join(t, server, "test", 10*time.Second, "game")
+			pc := session.PeerConnection
+
+			chat, err := pc.CreateDataChannel("chat", nil)
+			if err != nil {
+				t.Fatalf("Couldn't create datachannel: %s", err)
+			}
+			opened := make(chan struct{})
+			chat.OnOpen(func() { close(opened) })
+			offer, err := pc.CreateOffer(tc.options)
+			if err != nil {
+				t.Fatalf("Couldn't create offer: %s", err)
+			}
+			gatherComplete := webrtc.GatheringCompletePromise(pc)
+			if err := pc.SetLocalDescription(offer); err != nil {
+				t.Fatalf("Couldn't set local description: %s", err)
+			}
+			<-gatherComplete
+
+			path := "/pool/test/session/" + session.ID + "/" + tc.path
+			for _, secret := range []string{"", "wrong"} {
+				if resp, _ := apitest.PostOffer(t, server, path, secret, *pc.LocalDescription()); resp.StatusCode != http.StatusForbidden {
+					t.Errorf("Expected status 403 with secret %q, got %s", secret, resp.Status)
+				}
+			}
+
+			start := time.Now()
+			resp, answer := apitest.PostOffer(t, server, path, session.Secret, *pc.LocalDescription())
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("Unexpected status %s", resp.Status)
+			}
+			if d := time.Since(start); d > 10*time.Second {
+				t.Errorf("Answering took %s, expected it not to wait for the gathering timeout", d)
+			}
+			if err := pc.SetRemoteDescription(answer); err != nil {
+				t.Fatalf("Couldn't set remote description: %s", err)
+			}
+			select {
+			case <-opened:
+			case <-time.After(10 * time.Second):
+				t.Fatal("Timeout waiting for chat datachannel to open")
+			}
+		})
+	}
+}
+
+func TestRejoinRequiresSecret(t *testing.T) {
+	server, m := apitest.NewServer(t, api.Config{}, manager.WithICEServers(nil))
+	if _, err := m.NewPool("test", manager.PoolConfig{}); err != nil {
+		t.Fatalf("Couldn't create pool: %s", err)
+	}
+	session := apitest.Join(t, server, "test", 10*time.Second, "game")
+	path := "/pool/test/join/" + session.ID
+	for _, secret := range []string{"", "wrong"} {
+		_, offer := apitest.NewOffer(t, "game")
+		if resp, _ := apitest.PostOffer(t, server, path, secret, offer); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Expected status 403 with secret %q, got %s", secret, resp.Status)
+		}
+	}
+
+	_, offer := apitest.NewOffer(t, "game")
+	resp, _ := apitest.PostOffer(t, server, path, session.Secret, offer)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 with the session secret, got %s", resp.Status)
+	}
+	if secret := resp.Header.Get("X-Session-Secret"); secret != session.Secret {
+		t.Errorf("Expected the rejoined session to keep its secret, got %q", secret)
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		origins []string
+		origin  string
+		method  string
+		headers string
+		allowed bool
+	}{
+		{name: "create pool from any origin", origin: "https://game.example", method: http.MethodPut, allowed: true},
+		{name: "join with secret", origin: "https://game.example", method: http.MethodPost, headers: "X-Session-Secret", allowed: true},
+		{name: "unused method", origin: "https://game.example", method: http.MethodDelete},
+		{name: "create pool from allowed origin", origins: []string{"https://game.example"}, origin: "https://game.example", method: http.MethodPut, allowed: true},
+		{name: "other origin", origins: []string{"https://game.example"}, origin: "https://evil.example", method: http.MethodPut},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server, _ := apitest.NewServer(t, api.Config{CORSOrigins: tc.origins}, manager.WithICEServers(nil))
+			req, err := http.NewRequest(http.MethodOptions, server.URL+"/pool/test", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Origin", tc.origin)
+			req.Header.Set("Access-Control-Request-Method", tc.method)
+			if tc.headers != "" {
+				req.Header.Set("Access-Control-Request-Headers", tc.headers)
+			}
+			resp, err := server.Client().Do(req)
+			if err != nil {
+				t.Fatalf("Couldn't send preflight: %s", err)
+			}
+			resp.Body.Close()
+			allowed := resp.Header.Get("Access-Control-Allow-Origin") != "" &&
+				strings.Contains(resp.Header.Get("Access-Control-Allow-Methods"), tc.method)
+			if allowed != tc.allowed {
+				t.Errorf("Expected preflight allowed: %t, got headers %v", tc.allowed, resp.Header)
+			}
+		})
+	}
+}
+
+func TestHandleReady(t *testing.T) {
+	server, m := apitest.NewServer(t, api.Config{}, manager.WithICEServers(nil))
+	resp, err := server.Client().Get(server.URL + "/ready")
+	if err != nil {
+		t.Fatalf("Couldn't get readiness: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %s", resp.Status)
+	}
+
+	m.Drain()
+	resp, err = server.Client().Get(server.URL + "/ready")
+	if err != nil {
+		t.Fatalf("Couldn't get readiness: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status 503 while draining, got %s", resp.Status)
+	}
+	var body struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("Couldn't decode error: %s", err)
+	}
+	if body.Error.Code != "draining" {
+		t.Errorf("Expected error code draining, got %s", body.Error.Code)
+	}
+}
+
+func TestListenAndServeIPv6Loopback(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %s", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	logger := log.NewNopLogger()
+	m := manager.NewManager(logger)
+	defer m.Shutdown(context.Background())
+
+	if err := api.New(logger, m, &autocert.Manager{}, api.Config{Network: "tcp4"}).ListenAndServe(addr); err == nil {
+		t.Fatal("Expected tcp4 listener to reject IPv6 address")
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- api.New(logger, m, &autocert.Manager{}, api.Config{Network: "tcp6"}).ListenAndServe(addr)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		select {
+		case err := <-errc:
+			t.Fatalf("Couldn't listen on %s: %s", addr, err)
+		default:
+		}
+		resp, err := http.Get("http://" + addr + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("Expected status 200, got %s", resp.Status)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Couldn't reach %s: %s", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandleQueue(t *testing.T) {
+	server, m := apitest.NewServer(t, api.Config{})
+	if _, err := m.NewPool("test", manager.PoolConfig{}); err != nil {
+		t.Fatalf("Couldn't create pool: %s", err)
+	}
+	for _, tc := range []struct {
+		pool   string
+		status int
+		body   string
+	}{
+		{pool: "test", status: http.StatusOK, body: "event: slot-available\ndata: {}\n\n"},
+		{pool: "missing", status: http.StatusNotFound},
+	} {
+		t.Run(tc.pool, func(t *testing.T) {
+			resp, err := server.Client().Get(server.URL + "/pool/" + tc.pool + "/queue")
+			if err != nil {
+				t.Fatalf("Couldn't queue: %s", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tc.status {
+				t.Fatalf("Expected status %d, got %s", tc.status, resp.Status)
+			}
+			if tc.body == "" {
+				return
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Couldn't read events: %s", err)
+			}
+			if string(body) != tc.body {
+				t.Errorf("Expected %q, got %q", tc.body, body)
+			}
+		})
+	}
+}
+
+var (
+	tracerProviderOnce sync.Once
+	tracerProvider     *sdktrace.TracerProvider
+)
+
+// recordSpans records the spans ended until the test finishes.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	tracerProviderOnce.Do(func() {
+		tracerProvider = sdktrace.NewTracerProvider()
+		otel.SetTracerProvider(tracerProvider)
+	})
+	sr := tracetest.NewSpanRecorder()
+	tracerProvider.RegisterSpanProcessor(sr)
+	t.Cleanup(func() { tracerProvider.UnregisterSpanProcessor(sr) })
+	return sr
+}
+
+// spansByName returns the spans ended by sr by name.
+func spansByName(sr *tracetest.SpanRecorder) map[string][]sdktrace.ReadOnlySpan {
+	spans := map[string][]sdktrace.ReadOnlySpan{}
+	for _, s := range sr.Ended() {
+		spans[s.Name()] = append(spans[s.Name()], s)
+	}
+	return spans
+}
+
+func TestHandleJoinTraced(t *testing.T) {
+	sr := recordSpans(t)
+	server, m := apitest.NewServer(t, api.Config{}, manager.WithICEServers(nil))
+	if _, err := m.NewPool("test", manager.PoolConfig{}); err != nil {
+		t.Fatalf("Couldn't create pool: %s", err)
+	}
+	_, offer := apitest.NewOffer(t, "game")
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/pool/test/join", strings.NewReader(base64.StdEncoding.EncodeToString([]byte(offer.SDP))))
+	if err != nil {
+		t.Fatalf("Couldn't create request: %s", err)
+	}
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Couldn't join: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %s", resp.Status)
+	}
+
+	spans := spansByName(sr)
+	joins := spans["HandleJoin"]
+	if len(joins) != 1 || joins[0].SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || joins[0].Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Fatalf("Expected HandleJoin span continuing the trace of the request, got %v", joins)
+	}
+	join := joins[0].SpanContext()
+	for _, name := range []string{"SetRemoteDescription", "CreateAnswer", "ICEGathering"} {
+		s := spans[name]
+		if len(s) != 1 || s[0].Parent().SpanID() != join.SpanID() {
+			t.Errorf("Expected one %s span as child of HandleJoin, got %v", name, s)
+		}
+	}
+}
+
+func TestHandleBroadcastTraced(t *testing.T) {
+	server, m := apitest.NewServer(t, api.Config{AdminAPIKey: "secret"})
+	pool, err := m.NewPool("test", manager.PoolConfig{})
+	if err != nil {
+		t.Fatalf("Couldn't create pool: %s", err)
+	}
+	for _, tc := range []struct {
+		name    string
+		sampled bool
+	}{
+		{name: "sampled", sampled: true},
+		{name: "not sampled"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sr := recordSpans(t)
+			req, err := http.NewRequest(http.MethodPost, server.URL+"/pool/test/broadcast", strings.NewReader(`{"label":"game","data":"hi"}`))
+			if err != nil {
+				t.Fatalf("Couldn't create request: %s", err)
+			}
+			req.Header.Set("Authorization", "Bearer secret")
+			flags := "00"
+			if tc.sampled {
+				flags = "01"
+			}
+			req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-"+flags)
+			resp, err := server.Client().Do(req)
+			if err != nil {
+				t.Fatalf("Couldn't broadcast: %s", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNoContent {
+				t.Fatalf("Expected status 204, got %s", resp.Status)
+			}
+			spans := spansByName(sr)
+			if !tc.sampled {
+				if len(spans) != 0 {
+					t.Errorf("Expected no spans, got %v", spans)
+				}
+				return
+			}
+			handler, broadcast := spans["HandleBroadcast"], spans["broadcast"]
+			if len(handler) != 1 || len(broadcast) != 1 || broadcast[0].Parent().SpanID() != handler[0].SpanContext().SpanID() {
+				t.Errorf("Expected broadcast span as child of HandleBroadcast, got %v", spans)
+			}
+		})
+	}
+
+	// Broadcasts without a sampled parent, like the ones of sessions,
+	// aren't traced.
+	sr := recordSpans(t)
+	pool.Broadcast(context.Background(), "", "game", []byte("hi"))
+	if spans := sr.Ended(); len(spans) != 0 {
+		t.Errorf("Expected no spans, got %v", spans)
+	}
+}
@@ -0,0 +1,146 @@
+// Package apitest provides helpers for exercising the HTTP API end-to-end
+// without copying the wiring from cmd/server.
+package apitest
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/discordianfish/infisk8-server/api"
+	"github.com/discordianfish/infisk8-server/manager"
+	"github.com/go-kit/kit/log"
+	"github.com/pion/webrtc/v3"
+)
+
+// NewServer starts an in-memory API server backed by a new Manager created
+// with opts. The server and manager are shut down when the test finishes.
+func NewServer(t testing.TB, config api.Config, opts ...manager.ManagerOption) (*httptest.Server, *manager.Manager) {
+	t.Helper()
+	logger := log.NewNopLogger()
+	m := manager.NewManager(logger, opts...)
+	server := httptest.NewServer(api.New(logger, m, nil, config))
+	t.Cleanup(func() {
+		server.Close()
+		m.Shutdown(context.Background())
+	})
+	return server, m
+}
+
+// NewOffer creates a client peer connection with a datachannel for each
+// label and returns it along with its offer, ICE gathering already complete.
+// The peer connection is closed when the test finishes.
+func NewOffer(t testing.TB, labels ...string) (*webrtc.PeerConnection, webrtc.SessionDescription) {
+	t.Helper()
+	pc, _, offer := newOffer(t, labels)
+	return pc, offer
+}
+
+// Session is a session joined by Join.
+type Session struct {
+	// ID is the id of the session.
+	ID string
+	// Secret authorizes restarting, renegotiating and rejoining the session.
+	Secret string
+	// PeerConnection is the client's peer connection.
+	PeerConnection *webrtc.PeerConnection
+	// Channels are the open datachannels by label.
+	Channels map[string]*webrtc.DataChannel
+}
+
+// Join joins the existing pool on server with a datachannel for each label,
+// applies the answer and waits up to timeout for all channels to open.
+func Join(t testing.TB, server *httptest.Server, pool string, timeout time.Duration, labels ...string) *Session {
+	t.Helper()
+	pc, channels, offer := newOffer(t, labels)
+	resp, answer := PostOffer(t, server, "/pool/"+pool+"/join", "", offer)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Couldn't join pool %s: unexpected status %s", pool, resp.Status)
+	}
+
+	opened := make(chan string, len(channels))
+	for label, dc := range channels {
+		label := label
+		dc.OnOpen(func() { opened <- label })
+	}
+	if err := pc.SetRemoteDescription(answer); err != nil {
+		t.Fatalf("Couldn't set remote description: %s", err)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for range channels {
+		select {
+		case <-opened:
+		case <-timer.C:
+			t.Fatalf("Timeout waiting for datachannels to open")
+		}
+	}
+	return &Session{
+		ID:             resp.Header.Get("X-Session-Id"),
+		Secret:         resp.Header.Get("X-Session-Secret"),
+		PeerConnection: pc,
+		Channels:       channels,
+	}
+}
+
+// PostOffer posts the base64 encoded offer to path on server, along with the
+// session secret unless it's empty, and returns the response along with the
+// answer, which is only set if the status is 200. The response body is
+// closed already.
+func PostOffer(t testing.TB, server *httptest.Server, path, secret string, offer webrtc.SessionDescription) (*http.Response, webrtc.SessionDescription) {
+	t.Helper()
+	body := base64.StdEncoding.EncodeToString([]byte(offer.SDP))
+	req, err := http.NewRequest(http.MethodPost, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Couldn't create request: %s", err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	if secret != "" {
+		req.Header.Set("X-Session-Secret", secret)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Couldn't post offer to %s: %s", path, err)
+	}
+	defer resp.Body.Close()
+	var answer webrtc.SessionDescription
+	if resp.StatusCode != http.StatusOK {
+		return resp, answer
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		t.Fatalf("Couldn't decode answer: %s", err)
+	}
+	return resp, answer
+}
+
+func newOffer(t testing.TB, labels []string) (*webrtc.PeerConnection, map[string]*webrtc.DataChannel, webrtc.SessionDescription) {
+	t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("Couldn't create peer connection: %s", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	channels := make(map[string]*webrtc.DataChannel, len(labels))
+	for _, label := range labels {
+		dc, err := pc.CreateDataChannel(label, nil)
+		if err != nil {
+			t.Fatalf("Couldn't create datachannel %s: %s", label, err)
+		}
+		channels[label] = dc
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("Couldn't create offer: %s", err)
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatalf("Couldn't set local description: %s", err)
+	}
+	<-gatherComplete
+	return pc, channels, *pc.LocalDescription()
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// basicAuth requires requests to next to carry the given basic auth
+// credentials and responds with 401 Unauthorized otherwise.
+func basicAuth(username, password string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		// Evaluate both to not leak which one was wrong by timing.
+		userOK := subtle.ConstantTimeCompare([]byte(u), []byte(username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="infisk8"`)
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireAPIKey requires requests to h to carry the configured admin API key
+// as bearer token and responds with 401 Unauthorized otherwise.
+func (a *API) requireAPIKey(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(key), []byte(a.config.AdminAPIKey)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+			return
+		}
+		h(w, r, ps)
+	}
+}
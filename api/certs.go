@@ -0,0 +1,73 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// certReloader serves a certificate loaded from files which can be reloaded
+// without restarting the listeners using it.
+type certReloader struct {
+	certFile, keyFile string
+	cert              atomic.Value // *tls.Certificate
+}
+
+func (c *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("Couldn't load certificate: %w", err)
+	}
+	c.cert.Store(&cert)
+	return nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, ok := c.cert.Load().(*tls.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("No certificate loaded")
+	}
+	return cert, nil
+}
+
+// loadCertPool returns a pool of the PEM encoded certificates in file.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("Couldn't find certificates in %s", file)
+	}
+	return pool, nil
+}
+
+// clientCN returns the common name of the verified client certificate of r
+// or an empty string if there is none.
+func clientCN(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// ReloadCertificate reloads the certificate and key files, so new TLS
+// connections use the new certificate. Existing connections are kept. If
+// loading fails, the previous certificate stays in use.
+func (a *API) ReloadCertificate() error {
+	if a.certs == nil {
+		return fmt.Errorf("No certificate files configured")
+	}
+	if err := a.certs.load(); err != nil {
+		level.Error(a.logger).Log("msg", "Couldn't reload certificate", "error", err)
+		return err
+	}
+	level.Info(a.logger).Log("msg", "Reloaded certificate", "cert", a.certs.certFile)
+	return nil
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// ParseCIDRs parses a comma separated list of CIDRs.
+func ParseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	if s == "" {
+		return nets, nil
+	}
+	for _, c := range strings.Split(s, ",") {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(c))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR %q: %w", c, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP of the client that sent r. If the request comes
+// from a trusted proxy, the X-Forwarded-For and X-Real-IP headers are used
+// to find the IP of the client the proxy received it from. Requests over Unix
+// domain sockets are always considered to come from a trusted proxy.
+func (a *API) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && !containsIP(a.config.TrustedProxies, ip) {
+		return ip.String()
+	}
+
+	// Walk X-Forwarded-For from the right, skipping our own proxies.
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hip == nil {
+			break
+		}
+		if !containsIP(a.config.TrustedProxies, hip) {
+			return hip.String()
+		}
+	}
+	if rip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); rip != nil {
+		return rip.String()
+	}
+	if ip == nil {
+		return host
+	}
+	return ip.String()
+}
+
+// filterIPs responds with 403 Forbidden to requests from clients in the
+// denied networks or, if any allowed networks are configured, not in those.
+// Health and readiness checks are always let through.
+func (a *API) filterIPs(next http.Handler) http.Handler {
+	if len(a.config.AllowedNets) == 0 && len(a.config.DeniedNets) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/ready" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := net.ParseIP(a.clientIP(r))
+		if ip == nil || containsIP(a.config.DeniedNets, ip) ||
+			(len(a.config.AllowedNets) > 0 && !containsIP(a.config.AllowedNets, ip)) {
+			level.Debug(a.logger).Log("msg", "Rejecting request from client IP", "client_ip", ip, "path", r.URL.Path)
+			writeJSONError(w, http.StatusForbidden, "forbidden", "Forbidden")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
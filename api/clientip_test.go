@@ -0,0 +1,142 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestClientIP(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		trusted    string
+		remoteAddr string
+		xff        []string
+		xRealIP    string
+		expected   string
+	}{
+		{
+			name:       "direct",
+			remoteAddr: "203.0.113.7:1234",
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "spoofed X-Forwarded-For from untrusted peer",
+			trusted:    "10.0.0.0/8",
+			remoteAddr: "203.0.113.7:1234",
+			xff:        []string{"198.51.100.1"},
+			xRealIP:    "198.51.100.2",
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "trusted proxy",
+			trusted:    "10.0.0.0/8",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"203.0.113.7"},
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "multi-hop chain skips trusted proxies and spoofed hops",
+			trusted:    "10.0.0.0/8",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"198.51.100.1, 203.0.113.7", "10.0.0.3, 10.0.0.2"},
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "only trusted hops falls back to X-Real-IP",
+			trusted:    "10.0.0.0/8",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"10.0.0.2"},
+			xRealIP:    "203.0.113.7",
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "invalid hop stops the walk",
+			trusted:    "10.0.0.0/8",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"203.0.113.7, junk, 10.0.0.2"},
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "IPv6",
+			remoteAddr: "[2001:db8::1]:1234",
+			xff:        []string{"2001:db8::2"},
+			expected:   "2001:db8::1",
+		},
+		{
+			name:       "IPv6 trusted proxy",
+			trusted:    "fd00::/8",
+			remoteAddr: "[fd00::1]:1234",
+			xff:        []string{"2001:db8::2, fd00::2"},
+			expected:   "2001:db8::2",
+		},
+		{
+			name:       "Unix domain socket",
+			remoteAddr: "@",
+			xff:        []string{"203.0.113.7"},
+			expected:   "203.0.113.7",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			trusted, err := ParseCIDRs(tc.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := &API{config: Config{TrustedProxies: trusted}}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for _, v := range tc.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tc.xRealIP != "" {
+				r.Header.Set("X-Real-IP", tc.xRealIP)
+			}
+			if ip := a.clientIP(r); ip != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, ip)
+			}
+		})
+	}
+}
+
+func TestFilterIPs(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		allowed  string
+		denied   string
+		ip       string
+		path     string
+		expected int
+	}{
+		{name: "allowed", allowed: "203.0.113.0/24", ip: "203.0.113.7", path: "/pools", expected: http.StatusOK},
+		{name: "not allowed", allowed: "203.0.113.0/24", ip: "198.51.100.1", path: "/pools", expected: http.StatusForbidden},
+		{name: "denied", denied: "198.51.100.0/24", ip: "198.51.100.1", path: "/pools", expected: http.StatusForbidden},
+		{name: "not denied", denied: "198.51.100.0/24", ip: "203.0.113.7", path: "/pools", expected: http.StatusOK},
+		{name: "deny takes precedence", allowed: "198.51.100.0/16", denied: "198.51.100.0/24", ip: "198.51.100.1", path: "/pools", expected: http.StatusForbidden},
+		{name: "IPv6 denied", denied: "2001:db8::/32", ip: "2001:db8::1", path: "/pools", expected: http.StatusForbidden},
+		{name: "health check exempt", allowed: "203.0.113.0/24", ip: "198.51.100.1", path: "/healthz", expected: http.StatusOK},
+		{name: "readiness check exempt", denied: "198.51.100.0/24", ip: "198.51.100.1", path: "/ready", expected: http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			allowed, err := ParseCIDRs(tc.allowed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			denied, err := ParseCIDRs(tc.denied)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := &API{logger: log.NewNopLogger(), config: Config{AllowedNets: allowed, DeniedNets: denied}}
+			h := a.filterIPs(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			r.RemoteAddr = net.JoinHostPort(tc.ip, "1234")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.expected {
+				t.Errorf("Expected %d, got %d", tc.expected, w.Code)
+			}
+		})
+	}
+}
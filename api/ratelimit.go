@@ -0,0 +1,94 @@
+package api
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/julienschmidt/httprouter"
+)
+
+// rateLimiter is a token bucket rate limiter per key. It tracks at most size
+// keys, evicting the least recently used ones.
+type rateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+	size  int
+
+	mu      sync.Mutex // protects lru and buckets
+	lru     *list.List // of *bucket, most recently used first
+	buckets map[string]*list.Element
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst, size int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	if size < 1 {
+		size = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		size:    size,
+		lru:     list.New(),
+		buckets: make(map[string]*list.Element),
+	}
+}
+
+// allow takes a token for key if available. Otherwise it returns false and
+// how long to wait for the next token.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var b *bucket
+	if e, ok := l.buckets[key]; ok {
+		l.lru.MoveToFront(e)
+		b = e.Value.(*bucket)
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+	} else {
+		b = &bucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+		for l.lru.Len() > l.size {
+			e := l.lru.Back()
+			l.lru.Remove(e)
+			delete(l.buckets, e.Value.(*bucket).key)
+		}
+	}
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// rateLimit wraps h, limiting the rate of requests per client IP. Requests
+// exceeding the rate get a 429 response with a Retry-After header.
+func (a *API) rateLimit(h httprouter.Handle) httprouter.Handle {
+	if a.limiter == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		ip := a.clientIP(r)
+		if ok, wait := a.limiter.allow(ip); !ok {
+			level.Debug(a.logger).Log("msg", "Rate limit exceeded", "client_ip", ip, "path", r.URL.Path)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeJSONError(w, http.StatusTooManyRequests, "rate_limited", "Too many requests")
+			return
+		}
+		h(w, r, ps)
+	}
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestRateLimit(t *testing.T) {
+	a := &API{
+		logger:  log.NewNopLogger(),
+		limiter: newRateLimiter(0.001, 2, 10),
+	}
+	h := a.rateLimit(func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/pool/test/join", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h(w, r, nil)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := request("203.0.113.7:1234"); w.Code != http.StatusNoContent {
+			t.Fatalf("Expected request %d within burst to pass, got %d", i, w.Code)
+		}
+	}
+	w := request("203.0.113.7:1234")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 after burst, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Missing Retry-After header")
+	}
+	if w := request("203.0.113.8:1234"); w.Code != http.StatusNoContent {
+		t.Errorf("Expected other client IP not to be limited, got %d", w.Code)
+	}
+}
+
+func TestRateLimiterEvictsLeastRecentlyUsed(t *testing.T) {
+	l := newRateLimiter(0.001, 1, 2)
+	for _, key := range []string{"a", "b", "a", "c"} {
+		l.allow(key)
+	}
+	if _, ok := l.buckets["b"]; ok {
+		t.Error("Expected least recently used key b to be evicted")
+	}
+	if ok, _ := l.allow("a"); ok {
+		t.Error("Expected recently used key a to keep its empty bucket")
+	}
+	if ok, _ := l.allow("b"); !ok {
+		t.Error("Expected evicted key b to start with a full bucket")
+	}
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/discordianfish/infisk8-server/manager"
+	"github.com/go-kit/kit/log"
+)
+
+// writeCert writes a self-signed certificate for 127.0.0.1 and its key to
+// dir and returns the certificate.
+func writeCert(t *testing.T, dir string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Couldn't generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Couldn't create certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Couldn't encode key: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "cert.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Couldn't parse certificate: %s", err)
+	}
+	return cert
+}
+
+func TestListenAndServeTLSMaxConns(t *testing.T) {
+	dir := t.TempDir()
+	cert := writeCert(t, dir)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	logger := log.NewNopLogger()
+	m := manager.NewManager(logger)
+	defer m.Shutdown(context.Background())
+	a := New(logger, m, nil, Config{
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+		MaxConns: 2,
+	})
+	tlsSeen := make(chan bool, 1)
+	handler := a.handler
+	a.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case tlsSeen <- r.TLS != nil:
+		default:
+		}
+		handler.ServeHTTP(w, r)
+	})
+	errc := make(chan error, 1)
+	go func() { errc <- a.ListenAndServeTLS(addr) }()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		select {
+		case err := <-errc:
+			t.Fatalf("Couldn't listen on %s: %s", addr, err)
+		default:
+		}
+		resp, err := client.Get("https://" + addr + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("Expected status 200, got %s", resp.Status)
+			}
+			if resp.Proto != "HTTP/2.0" {
+				t.Errorf("Expected HTTP/2.0, got %s", resp.Proto)
+			}
+			if !<-tlsSeen {
+				t.Error("Expected r.TLS to be set")
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Couldn't reach %s: %s", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
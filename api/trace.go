@@ -0,0 +1,29 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/discordianfish/infisk8-server/api"
+
+// startSpan starts a server span called name for r, continuing the trace of
+// its W3C Trace Context traceparent header if there is one.
+func startSpan(r *http.Request, name string) (context.Context, trace.Span) {
+	ctx := propagation.TraceContext{}.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer))
+}
+
+// traceID returns the trace id of span, which carries the one of the
+// traceparent header even if tracing is disabled. It's empty if there is
+// none.
+func traceID(span trace.Span) string {
+	if sc := span.SpanContext(); sc.HasTraceID() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Config is the format of the JSON file given by -config. Its values are
+// used for the flags of the same name unless they're set on the command line.
+type Config struct {
+	Listen      string      `json:"listen"`
+	ListenTLS   string      `json:"listen_tls"`
+	AdminAddr   string      `json:"admin_addr"`
+	LogFormat   string      `json:"log_format"`
+	LogLevel    string      `json:"log_level"`
+	ICEServers  []ICEServer `json:"ice_servers"`
+	MaxPools    *int        `json:"max_pools"`
+	PoolTTL     string      `json:"pool_ttl"`
+	CORSOrigins []string    `json:"cors_origins"`
+	AllowCIDRs  []string    `json:"allow_cidrs"`
+	DenyCIDRs   []string    `json:"deny_cidrs"`
+}
+
+// ICEServer is a STUN or TURN server. TURN servers require credentials.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username"`
+	Credential string   `json:"credential"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	c := &Config{}
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("Couldn't parse config %s: %w", path, err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid config %s: %w", path, err)
+	}
+	return c, nil
+}
+
+func (c *Config) validate() error {
+	for i, s := range c.ICEServers {
+		if len(s.URLs) == 0 {
+			return fmt.Errorf("ICE server %d has no urls", i)
+		}
+		for _, u := range s.URLs {
+			if (strings.HasPrefix(u, "turn:") || strings.HasPrefix(u, "turns:")) && (s.Username == "" || s.Credential == "") {
+				return fmt.Errorf("TURN server %s requires username and credential", u)
+			}
+		}
+	}
+	if c.MaxPools != nil && *c.MaxPools < 0 {
+		return fmt.Errorf("max_pools must not be negative")
+	}
+	return nil
+}
+
+// flags returns the flag values set by c.
+func (c *Config) flags() map[string]string {
+	fs := map[string]string{}
+	for name, v := range map[string]string{
+		"l":            c.Listen,
+		"ls":           c.ListenTLS,
+		"admin-addr":   c.AdminAddr,
+		"log-format":   c.LogFormat,
+		"log-level":    c.LogLevel,
+		"pool-ttl":     c.PoolTTL,
+		"cors-origins": strings.Join(c.CORSOrigins, ","),
+		"allow-cidrs":  strings.Join(c.AllowCIDRs, ","),
+		"deny-cidrs":   strings.Join(c.DenyCIDRs, ","),
+	} {
+		if v != "" {
+			fs[name] = v
+		}
+	}
+	if c.MaxPools != nil {
+		fs["max-pools"] = strconv.Itoa(*c.MaxPools)
+	}
+	return fs
+}
+
+// apply sets the flags set by c which weren't given on the command line.
+func (c *Config) apply() error {
+	for name, v := range c.flags() {
+		if isFlagSet(name) {
+			continue
+		}
+		if err := flag.Set(name, v); err != nil {
+			return fmt.Errorf("Invalid value for %s in config: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// webrtcICEServers returns the ICE servers of c.
+func (c *Config) webrtcICEServers() []webrtc.ICEServer {
+	servers := make([]webrtc.ICEServer, len(c.ICEServers))
+	for i, s := range c.ICEServers {
+		servers[i] = webrtc.ICEServer{
+			URLs:           s.URLs,
+			Username:       s.Username,
+			Credential:     s.Credential,
+			CredentialType: webrtc.ICECredentialTypePassword,
+		}
+	}
+	return servers
+}
+
+// isFlagSet returns whether the flag name was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
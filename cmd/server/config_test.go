@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Couldn't write config: %s", err)
+	}
+	return path
+}
+
+func TestConfigApply(t *testing.T) {
+	if err := flag.CommandLine.Parse([]string{"-log-level=warn"}); err != nil {
+		t.Fatalf("Couldn't parse flags: %s", err)
+	}
+	c, err := loadConfig(writeConfig(t, `{
+		"log_level": "error",
+		"log_format": "json",
+		"max_pools": 3,
+		"pool_ttl": "1m",
+		"cors_origins": ["https://a.example", "https://b.example"],
+		"ice_servers": [{"urls": ["turn:turn.example"], "username": "u", "credential": "c"}]
+	}`))
+	if err != nil {
+		t.Fatalf("Couldn't load config: %s", err)
+	}
+	if err := c.apply(); err != nil {
+		t.Fatalf("Couldn't apply config: %s", err)
+	}
+
+	if *logLevel != "warn" {
+		t.Errorf("Expected flag given on the command line to take precedence, got log level %s", *logLevel)
+	}
+	if *logFormat != "json" {
+		t.Errorf("Expected log format json, got %s", *logFormat)
+	}
+	if *maxPools != 3 {
+		t.Errorf("Expected 3 max pools, got %d", *maxPools)
+	}
+	if *poolTTL != time.Minute {
+		t.Errorf("Expected pool TTL 1m, got %s", *poolTTL)
+	}
+	if *corsOrigins != "https://a.example,https://b.example" {
+		t.Errorf("Expected joined CORS origins, got %s", *corsOrigins)
+	}
+	if servers := c.webrtcICEServers(); len(servers) != 1 || servers[0].Username != "u" {
+		t.Errorf("Unexpected ICE servers %v", servers)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown field":          `{"listen_address": ":8080"}`,
+		"TURN without password":  `{"ice_servers": [{"urls": ["turn:turn.example"], "username": "u"}]}`,
+		"ICE server without url": `{"ice_servers": [{}]}`,
+		"negative max pools":     `{"max_pools": -1}`,
+		"not JSON":               `listen: ":8080"`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := loadConfig(writeConfig(t, content)); err == nil {
+				t.Error("Expected error")
+			}
+		})
+	}
+}
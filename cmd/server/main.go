@@ -1,28 +1,123 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
+	"fmt"
+	"math"
 	"math/rand"
+	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/discordianfish/infisk8-server/api"
 	"github.com/discordianfish/infisk8-server/manager"
+	"github.com/discordianfish/infisk8-server/redis"
+	"github.com/discordianfish/infisk8-server/tracing"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/pion/webrtc/v3"
+	"go.opentelemetry.io/otel"
 	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 )
 
+// Set via -ldflags "-X main.version=..." at build time.
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
 var (
 	logger = log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
 
-	listenHTTP  = flag.String("l", ":9000", "Address to listen on for HTTP")
+	configFile = flag.String("config", "", "Path to a JSON config file, flags given on the command line take precedence")
+
+	logFormat = flag.String("log-format", "logfmt", "Log format, one of: logfmt, json")
+	logLevel  = flag.String("log-level", "debug", "Minimum log level, one of: debug, info, warn, error")
+
+	listenHTTP  = flag.String("l", ":9000", "Address to listen on for HTTP, unix:/path/to/socket for a Unix domain socket")
 	listenHTTPS = flag.String("ls", "", "Address to listen on for HTTPS")
-	acmeDomain  = flag.String("ad", "", "Domain to use for acme")
+	maxConns    = flag.Int("max-conns", 0, "Maximum concurrent connections per API listener, further ones wait to be accepted, 0 for unlimited")
+	h2c         = flag.Bool("h2c", false, "Serve HTTP/2 without TLS on the plain listeners")
+	listenNet   = flag.String("listen-network", "tcp", "Network of the TCP listeners, one of: tcp, tcp4 (IPv4 only), tcp6 (IPv6 only)")
+	tlsCert     = flag.String("tls-cert", "", "Certificate file served on the HTTPS listener instead of one requested via acme, reloaded on SIGHUP")
+	tlsKey      = flag.String("tls-key", "", "Key file of -tls-cert")
+	tlsClientCA = flag.String("tls-client-ca", "", "PEM bundle of CAs to verify client certificates on the HTTPS listener against")
+	tlsAuth     = flag.String("tls-client-auth", "require-and-verify", "Client certificate policy if -tls-client-ca is set, one of: request, require, verify-if-given, require-and-verify")
+	acmeDomain  = flag.String("ad", "", "Comma separated domains to use for acme")
 	acmeEmail   = flag.String("ae", "", "Email to use for acme")
 	acmeURL     = flag.String("au", acme.LetsEncryptURL, "URL of acme service")
 	acmeCache   = flag.String("ac", "acme_cache", "Path to acme cache")
+	acmeType    = flag.String("acme-challenge", api.ChallengeHTTP01, "Acme challenge type, one of: http-01 (served on -l), tls-alpn-01 (served on -ls)")
+
+	adminAPIKey       = flag.String("admin-api-key", "", "Bearer token required by the admin endpoints, defaults to $ADMIN_API_KEY, admin endpoints are disabled if empty")
+	accessLog         = flag.Bool("access-log", false, "Log every API request at info level")
+	adminAddr         = flag.String("admin-addr", "", "Address to serve metrics, health and pprof on instead of the API listeners")
+	readHeaderTimeout = flag.Duration("read-header-timeout", 5*time.Second, "Maximum duration for reading request headers")
+	readTimeout       = flag.Duration("read-timeout", 10*time.Second, "Maximum duration for reading the entire request")
+	writeTimeout      = flag.Duration("write-timeout", 30*time.Second, "Maximum duration before timing out writes of the response")
+	idleTimeout       = flag.Duration("idle-timeout", 120*time.Second, "Maximum duration to wait for the next request on keep-alive connections")
+	corsOrigins       = flag.String("cors-origins", "", "Comma separated origins allowed to access the API, empty to allow all")
+	trustedProxies    = flag.String("trusted-proxies", "", "Comma separated CIDRs of proxies trusted to set X-Forwarded-For and X-Real-IP")
+	maxOfferSize      = flag.Int("max-offer-size", 10240, "Maximum size in bytes of the base64 encoded offer in join requests")
+	allowCIDRs        = flag.String("allow-cidrs", "", "Comma separated CIDRs of clients allowed to access the API, empty to allow all")
+	denyCIDRs         = flag.String("deny-cidrs", "", "Comma separated CIDRs of clients denied access to the API, takes precedence over -allow-cidrs")
+	joinRate          = flag.Float64("join-rate", 0, "Create and join requests allowed per client IP and second, 0 to disable")
+	joinBurst         = flag.Int("join-burst", 5, "Burst of create and join requests allowed per client IP")
+	enablePprof       = flag.Bool("pprof", false, "Serve pprof handlers under /debug/pprof/ and a state snapshot under /debug/vars, only enable when the API isn't publicly reachable")
+	rateLimitSize     = flag.Int("rate-limit-size", 10000, "Maximum number of client IPs tracked by the rate limiter")
+	metrics           = flag.Bool("metrics", true, "Serve Prometheus metrics on -metrics-path")
+	metricsPath       = flag.String("metrics-path", "/metrics", "Path to serve metrics on")
+	metricsNamespace  = flag.String("metrics-namespace", "infisk8", "Prometheus namespace prefixed to all metric names")
+	metricsSubsystem  = flag.String("metrics-subsystem", "", "Prometheus subsystem prefixed to all metric names after the namespace")
+	metricsUsername   = flag.String("metrics-username", "", "Username required to access metrics via basic auth")
+	metricsPassword   = flag.String("metrics-password", "", "Password required to access metrics via basic auth, defaults to $METRICS_PASSWORD")
+
+	nodeID            = flag.String("node-id", "", "Id of this instance in the pool registry, defaults to the hostname")
+	redisAddr         = flag.String("redis-addr", "", "Address of a Redis server to register pools in, so instances sharing it discover each other's pools, empty to keep them in memory")
+	redisPassword     = flag.String("redis-password", "", "Password of -redis-addr, defaults to $REDIS_PASSWORD")
+	redisPrefix       = flag.String("redis-prefix", redis.DefaultPrefix, "Prefix of the Redis keys pools are registered under")
+	messageBus        = flag.String("message-bus", "", "Message bus relaying broadcasts between instances, so sessions can join pools hosted elsewhere: \"redis\" for pub/sub on -redis-addr or empty to disable")
+	redisTTL          = flag.Duration("redis-ttl", redis.DefaultTTL, "Time keys of pools outlive this instance in Redis if it stops without deregistering them, they're refreshed every third of it")
+	iceServers        = flag.String("ice-servers", "stun:stun.l.google.com:19302", "Comma separated list of ICE server URLs")
+	relayOnly         = flag.Bool("relay-only", false, "Restrict peer connections of all pools to TURN relays, requires a TURN server")
+	maxPools          = flag.Int("max-pools", 0, "Maximum number of pools, 0 for unlimited")
+	maxPoolLabels     = flag.Int("max-pool-labels", 100, "Maximum number of distinct pool label values of metrics, further pools share the value _other, 0 for unlimited")
+	poolTTL           = flag.Duration("pool-ttl", 0, "Duration after which empty pools are closed, 0 to disable")
+	idAlphabet        = flag.String("id-alphabet", "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ", "Characters of generated session ids")
+	idLength          = flag.Int("id-length", 32, "Length of generated session ids, must give at least 64 bits of entropy")
+	maxLifetime       = flag.Duration("max-session-lifetime", 0, "Duration after which sessions are ended even if active, 0 for unlimited")
+	controlIdle       = flag.Duration("control-idle-timeout", 0, "Duration after which sessions silent on the control channel are closed, pongs count as activity, 0 to disable")
+	dataIdle          = flag.Duration("data-idle-timeout", 0, "Duration after which sessions silent on all data channels are closed, spectators are exempt, 0 to disable")
+	sendQueueSize     = flag.Int("send-queue-size", 256, "Number of messages queued for sending to a session before further ones are dropped")
+	maxBufferedAmount = flag.Uint64("max-buffered-amount", 1<<20, "Maximum bytes queued on a datachannel before messages to it are dropped, 0 to disable")
+	maxSendFailures   = flag.Int("max-send-failures", 10, "Consecutive send failures after which a session is closed, 0 to disable")
+	logSampleRate     = flag.Float64("log-sample-rate", 0.01, "Fraction of sent messages (0.0-1.0) logged at debug level")
+	controlLabel      = flag.String("control-label", "control", "Label of the server created datachannel for control events")
+	directLabel       = flag.String("direct-label", "direct", "Datachannel label reserved for direct messages between sessions")
+	gatheringTimeout  = flag.Duration("ice-gathering-timeout", 5*time.Second, "Maximum duration to wait for ICE candidate gathering before answering")
+	heartbeatInterval = flag.Duration("heartbeat-interval", 0, "Interval in which sessions are pinged on the control channel, 0 to disable")
+	heartbeatTimeout  = flag.Duration("heartbeat-timeout", 10*time.Second, "Duration after which sessions not answering a ping are closed")
+	nat1To1IPs        = flag.String("nat-1to1-ip", "", "Comma separated public IPs to advertise in ICE candidates when running behind 1:1 NAT")
+	nat1To1Type       = flag.String("nat-1to1-candidate-type", "host", "Candidate type the -nat-1to1-ip IPs are advertised as, one of: host, srflx")
+	icePortMin        = flag.Uint("ice-port-min", 0, "Lowest UDP port used for ICE, 0 for any")
+	icePortMax        = flag.Uint("ice-port-max", 0, "Highest UDP port used for ICE, 0 for any")
+	iceUDPMuxPort     = flag.Int("ice-udp-mux-port", 0, "UDP port shared by the ICE connections of all sessions, 0 to use a port per session")
+	receiveMTU        = flag.Uint("receive-mtu", 0, "Size in bytes of the buffer for incoming packets, 0 for pion's default")
+	statsInterval     = flag.Duration("stats-interval", 15*time.Second, "Interval in which connection stats of sessions are collected, 0 to disable")
+	labels            = flag.String("labels", "", "Comma separated datachannels created by the server as label:ordered|unordered[:max-retransmits[:coalesce-interval]], e.g. chat:ordered,position:unordered:0:33ms")
+	historySize       = flag.Int("history-size", 0, "Number of broadcast messages per label replayed to joining sessions, 0 to disable")
+	queueSize         = flag.Int("queue-size", 100, "Number of clients per pool which may wait for a slot in a full pool")
+	maxMessageSize    = flag.Int("max-message-size", 64<<10, "Maximum size in bytes of a received message, 0 to disable")
+	maxOversized      = flag.Int("max-oversized-messages", 0, "Oversized messages after which a session is closed, 0 to disable")
+	shutdownTimeout   = flag.Duration("shutdown-timeout", 10*time.Second, "Maximum duration to wait for sessions to close on shutdown")
 )
 
 func fatal(v interface{}) {
@@ -30,24 +125,433 @@ func fatal(v interface{}) {
 	os.Exit(1)
 }
 
+func newLogger(format, lvl string) (log.Logger, error) {
+	var l log.Logger
+	w := log.NewSyncWriter(os.Stderr)
+	switch format {
+	case "logfmt":
+		l = log.NewLogfmtLogger(w)
+	case "json":
+		l = log.NewJSONLogger(w)
+	default:
+		return nil, fmt.Errorf("Invalid log format %q", format)
+	}
+
+	var opt level.Option
+	switch lvl {
+	case "debug":
+		opt = level.AllowDebug()
+	case "info":
+		opt = level.AllowInfo()
+	case "warn":
+		opt = level.AllowWarn()
+	case "error":
+		opt = level.AllowError()
+	default:
+		return nil, fmt.Errorf("Invalid log level %q", lvl)
+	}
+	return level.NewFilter(l, opt), nil
+}
+
+// newWebRTCAPI returns the webrtc.API used to create peer connections,
+// configured by flags.
+func newWebRTCAPI() (*webrtc.API, error) {
+	se := webrtc.SettingEngine{}
+	if *nat1To1IPs != "" {
+		var ct webrtc.ICECandidateType
+		switch *nat1To1Type {
+		case "host":
+			ct = webrtc.ICECandidateTypeHost
+		case "srflx":
+			ct = webrtc.ICECandidateTypeSrflx
+		default:
+			return nil, fmt.Errorf("Invalid NAT 1:1 candidate type %q", *nat1To1Type)
+		}
+		ips, err := parseIPs(*nat1To1IPs)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid -nat-1to1-ip: %w", err)
+		}
+		se.SetNAT1To1IPs(ips, ct)
+	}
+	if *icePortMin != 0 || *icePortMax != 0 {
+		if *icePortMin == 0 || *icePortMax > math.MaxUint16 || *icePortMin > *icePortMax {
+			return nil, fmt.Errorf("Invalid ICE port range %d-%d", *icePortMin, *icePortMax)
+		}
+		if err := se.SetEphemeralUDPPortRange(uint16(*icePortMin), uint16(*icePortMax)); err != nil {
+			return nil, fmt.Errorf("Couldn't set ICE port range: %w", err)
+		}
+	}
+	if *iceUDPMuxPort != 0 {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: *iceUDPMuxPort})
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't listen for ICE: %w", err)
+		}
+		level.Info(logger).Log("msg", "Listening", "addr", conn.LocalAddr(), "proto", "ice+udp")
+		se.SetICEUDPMux(webrtc.NewICEUDPMux(nil, conn))
+	}
+	if *receiveMTU > 0 {
+		se.SetReceiveMTU(*receiveMTU)
+	}
+	return webrtc.NewAPI(webrtc.WithSettingEngine(se)), nil
+}
+
+// parseIPs parses a comma separated list of IPs.
+func parseIPs(s string) ([]string, error) {
+	var ips []string
+	for _, ip := range strings.Split(s, ",") {
+		ip = strings.TrimSpace(ip)
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("Invalid IP %q", ip)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// parseLabels parses the -labels flag value.
+func parseLabels(s string) (map[string]manager.LabelConfig, error) {
+	labels := make(map[string]manager.LabelConfig)
+	if s == "" {
+		return labels, nil
+	}
+	for _, l := range strings.Split(s, ",") {
+		fields := strings.Split(l, ":")
+		if len(fields) < 2 || len(fields) > 4 || fields[0] == "" {
+			return nil, fmt.Errorf("Invalid label %q", l)
+		}
+		var lc manager.LabelConfig
+		switch fields[1] {
+		case "ordered":
+			lc.Ordered = true
+		case "unordered":
+		default:
+			return nil, fmt.Errorf("Invalid ordering %q for label %s", fields[1], fields[0])
+		}
+		if len(fields) >= 3 && fields[2] != "" {
+			n, err := strconv.ParseUint(fields[2], 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid max retransmits for label %s: %w", fields[0], err)
+			}
+			mr := uint16(n)
+			lc.MaxRetransmits = &mr
+		}
+		if len(fields) == 4 {
+			d, err := time.ParseDuration(fields[3])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid coalesce interval for label %s: %w", fields[0], err)
+			}
+			lc.CoalesceInterval = d
+		}
+		labels[fields[0]] = lc
+	}
+	return labels, nil
+}
+
 func main() {
+	startTime := time.Now()
 	flag.Parse()
-	manager := manager.NewManager(logger)
+	var config *Config
+	if *configFile != "" {
+		c, err := loadConfig(*configFile)
+		if err != nil {
+			fatal(err)
+		}
+		if err := c.apply(); err != nil {
+			fatal(err)
+		}
+		config = c
+	}
+	l, err := newLogger(*logFormat, *logLevel)
+	if err != nil {
+		fatal(err)
+	}
+	logger = l
+	level.Info(logger).Log("msg", "Starting infisk8-server", "version", version, "commit", commit, "build_date", buildDate)
+
+	labelConfigs, err := parseLabels(*labels)
+	if err != nil {
+		fatal(err)
+	}
+
+	switch *listenNet {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		fatal("-listen-network must be one of: tcp, tcp4, tcp6")
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fatal("-tls-cert and -tls-key must be given together")
+	}
+	var clientAuth tls.ClientAuthType
+	switch *tlsAuth {
+	case "request":
+		clientAuth = tls.RequestClientCert
+	case "require":
+		clientAuth = tls.RequireAnyClientCert
+	case "verify-if-given":
+		clientAuth = tls.VerifyClientCertIfGiven
+	case "require-and-verify":
+		clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		fatal("-tls-client-auth must be one of: request, require, verify-if-given, require-and-verify")
+	}
+	if *sendQueueSize < 1 {
+		fatal("-send-queue-size must be at least 1")
+	}
+	if *logSampleRate < 0 || *logSampleRate > 1 {
+		fatal("-log-sample-rate must be between 0 and 1")
+	}
+	var servers []webrtc.ICEServer
+	if *iceServers != "" {
+		servers = []webrtc.ICEServer{{URLs: strings.Split(*iceServers, ",")}}
+	}
+	if config != nil && len(config.ICEServers) > 0 && !isFlagSet("ice-servers") {
+		servers = config.webrtcICEServers()
+	}
+	webrtcAPI, err := newWebRTCAPI()
+	if err != nil {
+		fatal(err)
+	}
+	if *nodeID == "" {
+		if *nodeID, err = os.Hostname(); err != nil {
+			fatal(err)
+		}
+	}
+	var (
+		registry      manager.PoolRegistry
+		closeRegistry = func() error { return nil }
+	)
+	if *redisAddr != "" {
+		if *redisPassword == "" {
+			*redisPassword = os.Getenv("REDIS_PASSWORD")
+		}
+		r := redis.NewRegistry(redis.Config{
+			Addr:     *redisAddr,
+			Password: *redisPassword,
+			Prefix:   *redisPrefix,
+			TTL:      *redisTTL,
+			Logger:   logger,
+		})
+		registry = r
+		closeRegistry = r.Close
+	}
+	var bus manager.MessageBus
+	switch *messageBus {
+	case "":
+	case "redis":
+		if *redisAddr == "" {
+			fatal("-message-bus=redis requires -redis-addr")
+		}
+		bus = redis.NewBus(redis.Config{
+			Addr:     *redisAddr,
+			Password: *redisPassword,
+			Prefix:   *redisPrefix,
+			Logger:   logger,
+		})
+	default:
+		fatal("-message-bus must be one of: redis or empty")
+	}
+	shutdownTracing := func(context.Context) error { return nil }
+	tp, err := tracing.NewTracerProviderFromEnv(context.Background(), "infisk8-server")
+	if err != nil {
+		fatal(err)
+	}
+	if tp != nil {
+		otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+			level.Warn(logger).Log("msg", "Couldn't export spans", "error", err)
+		}))
+		otel.SetTracerProvider(tp)
+		shutdownTracing = tp.Shutdown
+	}
+	idGenerator, err := manager.NewIDGenerator(*idAlphabet, *idLength)
+	if err != nil {
+		fatal(err)
+	}
+	manager.SetMetricsNamespace(*metricsNamespace, *metricsSubsystem)
+	api.SetMetricsNamespace(*metricsNamespace, *metricsSubsystem)
+	manager := manager.NewManager(logger,
+		manager.WithNodeID(*nodeID),
+		manager.WithPoolRegistry(registry),
+		manager.WithMessageBus(bus),
+		manager.WithWebRTCAPI(webrtcAPI),
+		manager.WithICEServers(servers),
+		manager.WithRelayOnly(*relayOnly),
+		manager.WithMaxPools(*maxPools),
+		manager.WithMaxPoolLabels(*maxPoolLabels),
+		manager.WithPoolTTL(*poolTTL),
+		manager.WithMaxSessionLifetime(*maxLifetime),
+		manager.WithIdleTimeouts(*controlIdle, *dataIdle),
+		manager.WithIDGenerator(idGenerator),
+		manager.WithSendQueueSize(*sendQueueSize),
+		manager.WithMaxBufferedAmount(*maxBufferedAmount),
+		manager.WithMaxSendFailures(*maxSendFailures),
+		manager.WithLogSampleRate(*logSampleRate),
+		manager.WithControlLabel(*controlLabel),
+		manager.WithDirectLabel(*directLabel),
+		manager.WithLabels(labelConfigs),
+		manager.WithStatsInterval(*statsInterval),
+		manager.WithHeartbeat(*heartbeatInterval, *heartbeatTimeout),
+		manager.WithGatheringTimeout(*gatheringTimeout),
+		manager.WithHistorySize(*historySize),
+		manager.WithQueueSize(*queueSize),
+		manager.WithMaxMessageSize(*maxMessageSize),
+		manager.WithMaxOversizedMessages(*maxOversized),
+	)
 	rand.Seed(time.Now().UTC().UnixNano())
 
-	var acm *autocert.Manager
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGUSR1)
+		<-sigs
+		manager.Drain()
+		ticker := time.NewTicker(time.Second)
+		for range ticker.C {
+			if manager.SessionCount() == 0 {
+				break
+			}
+		}
+		ticker.Stop()
+		level.Info(logger).Log("msg", "Drained, exiting")
+		// Shut down to deregister the pools and unsubscribe from the bus.
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := manager.Shutdown(ctx); err != nil {
+			fatal(err)
+		}
+		if err := closeRegistry(); err != nil {
+			level.Warn(logger).Log("msg", "Couldn't close pool registry", "error", err)
+		}
+		if err := shutdownTracing(ctx); err != nil {
+			level.Warn(logger).Log("msg", "Couldn't export pending spans", "error", err)
+		}
+		os.Exit(0)
+	}()
+
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		sig := <-sigs
+		level.Info(logger).Log("msg", "Shutting down", "signal", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := manager.Shutdown(ctx); err != nil {
+			fatal(err)
+		}
+		if err := closeRegistry(); err != nil {
+			level.Warn(logger).Log("msg", "Couldn't close pool registry", "error", err)
+		}
+		if err := shutdownTracing(ctx); err != nil {
+			level.Warn(logger).Log("msg", "Couldn't export pending spans", "error", err)
+		}
+		os.Exit(0)
+	}()
+
+	var acmeDomains []string
+	for _, d := range strings.Split(*acmeDomain, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			acmeDomains = append(acmeDomains, d)
+		}
+	}
+	if *acmeEmail != "" && len(acmeDomains) == 0 {
+		fatal("-ad must list at least one domain if -ae is set")
+	}
 
-	acm = &autocert.Manager{
-		Client: &acme.Client{
-			DirectoryURL: *acmeURL,
+	switch *acmeType {
+	case api.ChallengeHTTP01, api.ChallengeTLSALPN01:
+	default:
+		fatal("-acme-challenge must be one of: http-01, tls-alpn-01")
+	}
+
+	var acm *autocert.Manager
+	if *listenHTTPS != "" && *tlsCert == "" {
+		acm = &autocert.Manager{
+			Client: &acme.Client{
+				DirectoryURL: *acmeURL,
+			},
+			Email:      *acmeEmail,
+			Cache:      autocert.DirCache(*acmeCache),
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(acmeDomains...),
+		}
+	}
+	if *adminAPIKey == "" {
+		*adminAPIKey = os.Getenv("ADMIN_API_KEY")
+	}
+	if *metricsPassword == "" {
+		*metricsPassword = os.Getenv("METRICS_PASSWORD")
+	}
+	if !strings.HasPrefix(*metricsPath, "/") {
+		fatal("-metrics-path must start with /")
+	}
+	proxies, err := api.ParseCIDRs(*trustedProxies)
+	if err != nil {
+		fatal(err)
+	}
+	allowed, err := api.ParseCIDRs(*allowCIDRs)
+	if err != nil {
+		fatal(err)
+	}
+	denied, err := api.ParseCIDRs(*denyCIDRs)
+	if err != nil {
+		fatal(err)
+	}
+	var origins []string
+	if *corsOrigins != "" {
+		origins = strings.Split(*corsOrigins, ",")
+	}
+	api := api.New(logger, manager, acm, api.Config{
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+		TrustedProxies:    proxies,
+		CORSOrigins:       origins,
+		MaxOfferSize:      *maxOfferSize,
+		AllowedNets:       allowed,
+		DeniedNets:        denied,
+		JoinRate:          *joinRate,
+		JoinBurst:         *joinBurst,
+		RateLimitSize:     *rateLimitSize,
+		EnablePprof:       *enablePprof,
+		AdminAPIKey:       *adminAPIKey,
+		AccessLog:         *accessLog,
+		AdminAddr:         *adminAddr,
+		Network:           *listenNet,
+		CertFile:          *tlsCert,
+		ClientCAFile:      *tlsClientCA,
+		ClientAuth:        clientAuth,
+		H2C:               *h2c,
+		MaxConns:          *maxConns,
+		ACMEChallenge:     *acmeType,
+		KeyFile:           *tlsKey,
+		MetricsPath:       *metricsPath,
+		DisableMetrics:    !*metrics,
+		MetricsUsername:   *metricsUsername,
+		MetricsPassword:   *metricsPassword,
+		StartTime:         startTime,
+		BuildInfo: api.BuildInfo{
+			Version:   version,
+			Commit:    commit,
+			BuildDate: buildDate,
 		},
-		Cache:      autocert.DirCache(*acmeCache),
-		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist(*acmeDomain),
+	})
+	if *tlsCert != "" {
+		go func() {
+			sigs := make(chan os.Signal, 1)
+			signal.Notify(sigs, syscall.SIGHUP)
+			for range sigs {
+				api.ReloadCertificate() // Logs errors and keeps the old certificate
+			}
+		}()
+	}
+	if *adminAddr != "" {
+		go func() {
+			if err := api.ListenAndServeAdmin(); err != nil {
+				fatal(err)
+			}
+		}()
 	}
-	api := api.New(logger, manager, acm)
 	if *listenHTTPS != "" {
-		level.Debug(logger).Log("msg", "here");
+		level.Debug(logger).Log("msg", "here")
 		go func() {
 			if err := api.ListenAndServeTLS(*listenHTTPS); err != nil {
 				fatal(err)
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseIPs(t *testing.T) {
+	ips, err := parseIPs("203.0.113.7, 2001:db8::1 ,198.51.100.1")
+	if err != nil {
+		t.Fatalf("Couldn't parse IPs: %s", err)
+	}
+	if expected := []string{"203.0.113.7", "2001:db8::1", "198.51.100.1"}; !reflect.DeepEqual(ips, expected) {
+		t.Errorf("Expected %v, got %v", expected, ips)
+	}
+	for _, s := range []string{"203.0.113.7,", "example.com", "203.0.113.0/24"} {
+		if _, err := parseIPs(s); err == nil {
+			t.Errorf("Expected error parsing %q", s)
+		}
+	}
+}
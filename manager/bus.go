@@ -0,0 +1,55 @@
+package manager
+
+import (
+	"github.com/go-kit/kit/log/level"
+)
+
+// MessageBus relays broadcasts between server instances hosting sessions of
+// the same pool. Implementations must be safe for concurrent use.
+type MessageBus interface {
+	// Publish sends msg to all instances subscribed to its pool.
+	Publish(msg BusMessage) error
+	// Subscribe calls f for every message published to pool until the
+	// returned unsubscribe function gets called.
+	Subscribe(pool string, f func(BusMessage)) (func(), error)
+}
+
+// BusMessage is a broadcast relayed by a MessageBus.
+type BusMessage struct {
+	Origin string `json:"origin"` // Node id of the publishing instance
+	Pool   string `json:"pool"`
+	Sender string `json:"sender"` // Session id
+	Label  string `json:"label"`
+	Data   []byte `json:"data"`
+}
+
+// subscribe makes the pool deliver broadcasts published by other instances
+// to its local sessions.
+func (p *Pool) subscribe() error {
+	unsubscribe, err := p.bus.Subscribe(p.name, func(msg BusMessage) {
+		defer recoverPanic(p.logger)
+		if msg.Origin == p.nodeID { // Already delivered locally
+			return
+		}
+		p.broadcast(p.ctx, msg.Sender, msg.Label, msg.Data)
+	})
+	if err != nil {
+		return err
+	}
+	p.unsubscribe = unsubscribe
+	return nil
+}
+
+// publish sends a broadcast of a local session to other instances.
+func (p *Pool) publish(cid, label string, data []byte) {
+	err := p.bus.Publish(BusMessage{
+		Origin: p.nodeID,
+		Pool:   p.name,
+		Sender: cid,
+		Label:  label,
+		Data:   data,
+	})
+	if err != nil {
+		level.Warn(p.logger).Log("msg", "Couldn't publish broadcast", "error", err)
+	}
+}
@@ -0,0 +1,39 @@
+package manager
+
+import (
+	"time"
+)
+
+// coalesce stores data as the latest message of the session on label,
+// replacing any message not flushed yet.
+func (p *Session) coalesce(label string, data []byte) {
+	p.mu.Lock()
+	_, replaced := p.coalesced[label]
+	p.coalesced[label] = data
+	p.mu.Unlock()
+	if replaced {
+		messageDroppedCounter.WithLabelValues("coalesced").Inc()
+	}
+}
+
+// flushCoalesced broadcasts the latest message of the session on label every
+// interval until the session gets closed.
+func (p *Session) flushCoalesced(label string, interval time.Duration) {
+	defer recoverPanic(p.logger)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+		}
+		p.mu.Lock()
+		data, ok := p.coalesced[label]
+		delete(p.coalesced, label)
+		p.mu.Unlock()
+		if ok {
+			p.relay(p.Pool.ctx, label, data)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package manager
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCoalesce(t *testing.T) {
+	pcs := &fakePeerConnections{}
+	labels := map[string]LabelConfig{
+		"pos":  {CoalesceInterval: time.Hour}, // Flushed by the test
+		"chat": {Ordered: true},
+	}
+	pool := newTestPool(t, PoolConfig{}, WithPeerConnectionFactory(pcs.new), WithLabels(labels))
+	pos := pcs.join(t, pool, SessionConfig{}, "pos", "a", "b")
+	chat := map[string]*fakeDataChannel{
+		"a": pcs.get(0).openChannel("chat"),
+		"b": pcs.get(1).openChannel("chat"),
+	}
+
+	for _, m := range []string{"1", "2", "3"} {
+		pos["a"].receive([]byte(m))
+		chat["a"].receive([]byte(m))
+	}
+	// Messages on other labels get relayed right away.
+	for _, m := range []string{"1", "2", "3"} {
+		expectSent(t, chat["b"], []byte(m))
+	}
+	expectNothingSent(t, pos["b"])
+
+	a := session(pool, "a")
+	go a.flushCoalesced("pos", 10*time.Millisecond)
+	expectSent(t, pos["b"], []byte("3"))
+	expectNothingSent(t, pos["b"])
+	expectNothingSent(t, pos["a"])
+}
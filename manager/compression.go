@@ -0,0 +1,36 @@
+package manager
+
+import (
+	"bytes"
+	"compress/flate"
+	"sync"
+)
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed) // Only fails on invalid level
+		return w
+	},
+}
+
+// deflate compresses data as raw DEFLATE stream (RFC 1951), which browsers
+// can decompress with DecompressionStream("deflate-raw").
+func deflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compresses returns whether messages on label to the session get
+// compressed. Control events never are.
+func (p *Session) compresses(label string) bool {
+	return p.Pool.compress && p.config.Compression && label != p.controlLabel
+}
@@ -0,0 +1,61 @@
+package manager
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func inflate(t *testing.T, data []byte) []byte {
+	t.Helper()
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Couldn't decompress: %s", err)
+	}
+	return out
+}
+
+func TestDeflate(t *testing.T) {
+	// Compress repeatedly to reuse the pooled writers.
+	for _, data := range []string{"", "hello", strings.Repeat("position ", 1000), "hello"} {
+		compressed, err := deflate([]byte(data))
+		if err != nil {
+			t.Fatalf("Couldn't compress: %s", err)
+		}
+		if out := inflate(t, compressed); string(out) != data {
+			t.Errorf("Expected %q after round trip, got %q", data, out)
+		}
+	}
+}
+
+func TestCompressedBroadcast(t *testing.T) {
+	pcs := &fakePeerConnections{}
+	pool := newTestPool(t, PoolConfig{Compress: true}, WithPeerConnectionFactory(pcs.new))
+	compressed := pcs.join(t, pool, SessionConfig{Compression: true}, "game", "a")
+	raw := pcs.join(t, pool, SessionConfig{}, "game", "b")
+
+	data := []byte(strings.Repeat("position ", 100))
+	pool.Broadcast(context.Background(), "", "game", data)
+	select {
+	case sent := <-compressed["a"].sent:
+		if len(sent) >= len(data) {
+			t.Errorf("Expected message to be compressed, got %d bytes for %d", len(sent), len(data))
+		}
+		if out := inflate(t, sent); !bytes.Equal(out, data) {
+			t.Errorf("Expected %q after decompressing, got %q", data, out)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timeout waiting for compressed message")
+	}
+	expectSent(t, raw["b"], data)
+
+	if s := session(pool, "a"); s.compresses(s.controlLabel) {
+		t.Error("Expected control events not to be compressed")
+	}
+}
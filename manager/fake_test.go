@@ -0,0 +1,283 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// fakeOffer is an offer accepted by fakePeerConnection.
+var fakeOffer = []byte("v=0\r\nm=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\n")
+
+// fakePeerConnection is a PeerConnection without ICE, DTLS or SCTP. ICE
+// gathering completes as soon as the local description is set first and
+// datachannels only open when the test says so.
+type fakePeerConnection struct {
+	mu                  sync.Mutex
+	local               *webrtc.SessionDescription
+	channels            []*fakeDataChannel
+	closed              bool
+	onDataChannel       func(DataChannel)
+	onConnectionState   func(webrtc.PeerConnectionState)
+	onICEGatheringState func(webrtc.ICEGathererState)
+}
+
+// fakePeerConnections is a PeerConnectionFactory creating fakePeerConnections
+// and recording them in the order they were created.
+type fakePeerConnections struct {
+	mu  sync.Mutex
+	pcs []*fakePeerConnection
+}
+
+func (f *fakePeerConnections) new(webrtc.Configuration) (PeerConnection, error) {
+	pc := &fakePeerConnection{}
+	f.mu.Lock()
+	f.pcs = append(f.pcs, pc)
+	f.mu.Unlock()
+	return pc, nil
+}
+
+func (f *fakePeerConnections) get(i int) *fakePeerConnection {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.pcs[i]
+}
+
+// join joins a session for each id to pool, which must use f, and opens a
+// datachannel with label for each. It returns the datachannels by id.
+func (f *fakePeerConnections) join(t *testing.T, pool *Pool, config SessionConfig, label string, ids ...string) map[string]*fakeDataChannel {
+	t.Helper()
+	channels := make(map[string]*fakeDataChannel, len(ids))
+	for _, id := range ids {
+		if _, err := pool.NewSession(context.Background(), fakeOffer, id, config); err != nil {
+			t.Fatalf("Couldn't join %s: %s", id, err)
+		}
+		f.mu.Lock()
+		pc := f.pcs[len(f.pcs)-1]
+		f.mu.Unlock()
+		channels[id] = pc.openChannel(label)
+	}
+	return channels
+}
+
+func (pc *fakePeerConnection) SetRemoteDescription(webrtc.SessionDescription) error {
+	return nil
+}
+
+func (pc *fakePeerConnection) CreateAnswer(*webrtc.AnswerOptions) (webrtc.SessionDescription, error) {
+	return webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: "v=0\r\n"}, nil
+}
+
+// SetLocalDescription completes gathering the first time it's called. Like
+// pion, later calls keep the candidates without changing the gathering state.
+func (pc *fakePeerConnection) SetLocalDescription(sd webrtc.SessionDescription) error {
+	pc.mu.Lock()
+	first := pc.local == nil
+	pc.local = &sd
+	f := pc.onICEGatheringState
+	pc.mu.Unlock()
+	if first && f != nil {
+		f(webrtc.ICEGathererStateComplete)
+	}
+	return nil
+}
+
+func (pc *fakePeerConnection) LocalDescription() *webrtc.SessionDescription {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.local
+}
+
+func (pc *fakePeerConnection) ICEGatheringState() webrtc.ICEGatheringState {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.local == nil {
+		return webrtc.ICEGatheringStateNew
+	}
+	return webrtc.ICEGatheringStateComplete
+}
+
+func (pc *fakePeerConnection) CreateDataChannel(label string, init *webrtc.DataChannelInit) (DataChannel, error) {
+	dc := newFakeDataChannel(label)
+	if init != nil && init.Ordered != nil {
+		dc.ordered = *init.Ordered
+	}
+	pc.mu.Lock()
+	pc.channels = append(pc.channels, dc)
+	pc.mu.Unlock()
+	return dc, nil
+}
+
+func (pc *fakePeerConnection) GetStats() webrtc.StatsReport {
+	return webrtc.StatsReport{}
+}
+
+func (pc *fakePeerConnection) Close() error {
+	pc.mu.Lock()
+	if pc.closed {
+		pc.mu.Unlock()
+		return nil
+	}
+	pc.closed = true
+	channels := pc.channels
+	pc.mu.Unlock()
+	for _, dc := range channels {
+		dc.Close()
+	}
+	return nil
+}
+
+func (pc *fakePeerConnection) OnDataChannel(f func(DataChannel)) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.onDataChannel = f
+}
+
+func (pc *fakePeerConnection) OnConnectionStateChange(f func(webrtc.PeerConnectionState)) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.onConnectionState = f
+}
+
+func (pc *fakePeerConnection) OnICEGatheringStateChange(f func(webrtc.ICEGathererState)) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.onICEGatheringState = f
+}
+
+// openChannel opens a datachannel like a client would, announcing it to the
+// session and opening it right away.
+func (pc *fakePeerConnection) openChannel(label string) *fakeDataChannel {
+	return pc.openDataChannel(newFakeDataChannel(label))
+}
+
+// openDataChannel is like openChannel for a given datachannel.
+func (pc *fakePeerConnection) openDataChannel(dc *fakeDataChannel) *fakeDataChannel {
+	pc.mu.Lock()
+	pc.channels = append(pc.channels, dc)
+	f := pc.onDataChannel
+	pc.mu.Unlock()
+	f(dc)
+	dc.open()
+	return dc
+}
+
+// fakeDataChannel is a DataChannel recording the messages sent on it.
+type fakeDataChannel struct {
+	label   string
+	ordered bool
+
+	mu        sync.Mutex
+	state     webrtc.DataChannelState
+	sent      chan []byte
+	onOpen    func()
+	onClose   func()
+	onMessage func(webrtc.DataChannelMessage)
+}
+
+func newFakeDataChannel(label string) *fakeDataChannel {
+	return &fakeDataChannel{
+		label:   label,
+		ordered: true,
+		state:   webrtc.DataChannelStateConnecting,
+		sent:    make(chan []byte, 100),
+	}
+}
+
+func (dc *fakeDataChannel) Label() string { return dc.label }
+func (dc *fakeDataChannel) ID() *uint16   { return nil }
+func (dc *fakeDataChannel) Ordered() bool { return dc.ordered }
+
+func (dc *fakeDataChannel) ReadyState() webrtc.DataChannelState {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.state
+}
+
+func (dc *fakeDataChannel) BufferedAmount() uint64 { return 0 }
+
+func (dc *fakeDataChannel) Send(data []byte) error {
+	if dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return errors.New("Datachannel isn't open")
+	}
+	dc.sent <- append([]byte(nil), data...)
+	return nil
+}
+
+func (dc *fakeDataChannel) Close() error {
+	dc.mu.Lock()
+	if dc.state == webrtc.DataChannelStateClosed {
+		dc.mu.Unlock()
+		return nil
+	}
+	dc.state = webrtc.DataChannelStateClosed
+	f := dc.onClose
+	dc.mu.Unlock()
+	if f != nil {
+		f()
+	}
+	return nil
+}
+
+func (dc *fakeDataChannel) OnOpen(f func()) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.onOpen = f
+}
+
+func (dc *fakeDataChannel) OnClose(f func()) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.onClose = f
+}
+
+func (dc *fakeDataChannel) OnMessage(f func(webrtc.DataChannelMessage)) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.onMessage = f
+}
+
+func (dc *fakeDataChannel) open() {
+	dc.mu.Lock()
+	dc.state = webrtc.DataChannelStateOpen
+	f := dc.onOpen
+	dc.mu.Unlock()
+	if f != nil {
+		f()
+	}
+}
+
+// receive delivers data to the session as if the client sent it.
+func (dc *fakeDataChannel) receive(data []byte) {
+	dc.mu.Lock()
+	f := dc.onMessage
+	dc.mu.Unlock()
+	f(webrtc.DataChannelMessage{Data: data})
+}
+
+// expectSent fails the test unless data gets sent on dc.
+func expectSent(t *testing.T, dc *fakeDataChannel, data []byte) {
+	t.Helper()
+	select {
+	case sent := <-dc.sent:
+		if string(sent) != string(data) {
+			t.Errorf("Expected %q to be sent on %s, got %q", data, dc.label, sent)
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("Timeout waiting for %q to be sent on %s", data, dc.label)
+	}
+}
+
+// expectNothingSent fails the test if anything gets sent on dc shortly.
+func expectNothingSent(t *testing.T, dc *fakeDataChannel) {
+	t.Helper()
+	select {
+	case sent := <-dc.sent:
+		t.Errorf("Expected nothing to be sent on %s, got %q", dc.label, sent)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
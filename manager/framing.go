@@ -0,0 +1,63 @@
+package manager
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// Frame types of binary messages in pools with binary framing. The first
+// byte of a message is its type:
+//
+//	frameBroadcast: [0][payload] is relayed as is, like unframed messages.
+//	frameUnicast:   [1][id length][id][payload] is sent to the session with
+//	                the id, which is replaced by the sender's id.
+//	frameControl:   [2][payload] is handled like a message on the control
+//	                label, e.g. a pong.
+const (
+	frameBroadcast byte = iota
+	frameUnicast
+	frameControl
+)
+
+// routeFrame routes the binary framed message data received on label by its
+// frame type.
+func (p *Session) routeFrame(ctx context.Context, label string, data []byte) {
+	if len(data) == 0 {
+		messageDroppedCounter.WithLabelValues("invalid").Inc()
+		return
+	}
+	switch data[0] {
+	case frameBroadcast:
+		p.relay(ctx, label, data)
+	case frameUnicast:
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			messageDroppedCounter.WithLabelValues("invalid").Inc()
+			level.Debug(p.logger).Log("msg", "Dropping unicast frame with truncated recipient")
+			return
+		}
+		if len(p.ID) > 255 {
+			messageDroppedCounter.WithLabelValues("invalid").Inc()
+			level.Debug(p.logger).Log("msg", "Dropping unicast frame, sender id too long for framing")
+			return
+		}
+		n := 2 + int(data[1])
+		to := string(data[2:n])
+		msg := append([]byte{frameUnicast, byte(len(p.ID))}, p.ID...)
+		msg = append(msg, data[n:]...)
+		if err := p.Pool.SendTo(p.ID, to, label, msg); err != nil {
+			if !errors.Is(err, ErrQueueFull) { // Counted when dropped already
+				messageDroppedCounter.WithLabelValues("no_recipient").Inc()
+			}
+			level.Debug(p.logger).Log("msg", "Couldn't send unicast frame", "error", err)
+		}
+	case frameControl:
+		if !p.handlePong(data[1:]) {
+			messageDroppedCounter.WithLabelValues("invalid").Inc()
+		}
+	default:
+		messageDroppedCounter.WithLabelValues("invalid").Inc()
+		level.Debug(p.logger).Log("msg", "Dropping frame of unknown type", "type", data[0])
+	}
+}
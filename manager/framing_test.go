@@ -0,0 +1,63 @@
+package manager
+
+import (
+	"testing"
+)
+
+func TestRouteFrame(t *testing.T) {
+	pcs := &fakePeerConnections{}
+	pool := newTestPool(t, PoolConfig{BinaryFraming: true}, WithPeerConnectionFactory(pcs.new))
+	channels := pcs.join(t, pool, SessionConfig{}, "game", "a", "bb", "c")
+
+	for _, tc := range []struct {
+		name     string
+		data     []byte
+		expected map[string][]byte
+	}{
+		{
+			name:     "broadcast",
+			data:     []byte{frameBroadcast, 'h', 'i'},
+			expected: map[string][]byte{"bb": {frameBroadcast, 'h', 'i'}, "c": {frameBroadcast, 'h', 'i'}},
+		},
+		{
+			name:     "unicast gets sender id",
+			data:     []byte{frameUnicast, 2, 'b', 'b', 'h', 'i'},
+			expected: map[string][]byte{"bb": {frameUnicast, 1, 'a', 'h', 'i'}},
+		},
+		{
+			name: "unicast to unknown session",
+			data: []byte{frameUnicast, 1, 'x', 'h', 'i'},
+		},
+		{
+			name: "truncated recipient",
+			data: []byte{frameUnicast, 5, 'b', 'b'},
+		},
+		{
+			name: "missing recipient length",
+			data: []byte{frameUnicast},
+		},
+		{
+			name: "control",
+			data: append([]byte{frameControl}, `{"event":"pong"}`...),
+		},
+		{
+			name: "unknown type",
+			data: []byte{9, 'h', 'i'},
+		},
+		{
+			name: "empty",
+			data: []byte{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			channels["a"].receive(tc.data)
+			for id, dc := range channels {
+				if data, ok := tc.expected[id]; ok {
+					expectSent(t, dc, data)
+				} else {
+					expectNothingSent(t, dc)
+				}
+			}
+		})
+	}
+}
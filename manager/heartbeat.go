@@ -0,0 +1,67 @@
+package manager
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// heartbeat periodically sends a ping event on the control channel of the
+// session until it gets closed. If the client doesn't answer with a pong
+// event within timeout, the session gets closed. The timeout is checked on
+// every interval.
+func (p *Session) heartbeat(interval, timeout time.Duration) {
+	defer recoverPanic(p.logger)
+	ping, err := json.Marshal(controlEvent{Event: "ping", ID: p.ID})
+	if err != nil {
+		level.Error(p.logger).Log("msg", "Couldn't encode ping", "error", err)
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+		}
+		p.mu.Lock()
+		open := p.open
+		outstanding := p.lastPong.Before(p.pingSent)
+		sent := p.pingSent
+		if open && !outstanding {
+			p.pingSent = time.Now()
+		}
+		p.mu.Unlock()
+		if !open {
+			continue
+		}
+		if outstanding {
+			if time.Since(sent) < timeout {
+				continue
+			}
+			level.Info(p.logger).Log("msg", "Closing session after heartbeat timeout", "timeout", timeout)
+			if err := p.Pool.closeSession(p, "heartbeat_timeout"); err != nil {
+				level.Warn(p.logger).Log("msg", "Couldn't close session", "error", err)
+			}
+			return
+		}
+		if err := p.send(p.controlLabel, 0, ping); err != nil {
+			level.Debug(p.logger).Log("msg", "Couldn't send ping", "error", err)
+		}
+	}
+}
+
+// handlePong records data as pong if it's a pong event and returns whether
+// it was one.
+func (p *Session) handlePong(data []byte) bool {
+	var ev controlEvent
+	if err := json.Unmarshal(data, &ev); err != nil || ev.Event != "pong" {
+		return false
+	}
+	p.mu.Lock()
+	p.lastPong = time.Now()
+	p.mu.Unlock()
+	return true
+}
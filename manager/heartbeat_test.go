@@ -0,0 +1,61 @@
+package manager
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	pcs := &fakePeerConnections{}
+	pool := newTestPool(t, PoolConfig{}, WithPeerConnectionFactory(pcs.new), WithHeartbeat(20*time.Millisecond, 100*time.Millisecond))
+	channels := pcs.join(t, pool, SessionConfig{}, defaultControlLabel, "alive", "silent")
+
+	// Answer all pings of alive.
+	stop := make(chan struct{})
+	defer close(stop)
+	pings := make(chan struct{}, 100)
+	go func() {
+		dc := channels["alive"]
+		for {
+			select {
+			case <-stop:
+				return
+			case data := <-dc.sent:
+				var ev controlEvent
+				if json.Unmarshal(data, &ev) == nil && ev.Event == "ping" {
+					dc.receive([]byte(`{"event":"pong"}`))
+					pings <- struct{}{}
+				}
+			}
+		}
+	}()
+
+	waitFor(t, func() bool { return session(pool, "silent") == nil })
+	for i := 0; i < 5; i++ {
+		select {
+		case <-pings:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timeout waiting for ping")
+		}
+	}
+	if session(pool, "alive") == nil {
+		t.Error("Session answering pings got closed")
+	}
+}
+
+func TestHandlePong(t *testing.T) {
+	s := &Session{}
+	for data, expected := range map[string]bool{
+		`{"event":"pong"}`: true,
+		`{"event":"ping"}`: false,
+		`pong`:             false,
+	} {
+		if got := s.handlePong([]byte(data)); got != expected {
+			t.Errorf("Expected handlePong(%s) to return %t, got %t", data, expected, got)
+		}
+	}
+	if s.lastPong.IsZero() {
+		t.Error("Expected pong to be recorded")
+	}
+}
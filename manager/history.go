@@ -0,0 +1,73 @@
+package manager
+
+import "sync"
+
+// history keeps the most recent broadcast messages per label so they can be
+// replayed to sessions joining later. Every message gets a sequence number
+// which lets sessions skip live messages they already got replayed.
+type history struct {
+	size int
+
+	mu    sync.Mutex // protects seq and rings
+	seq   uint64
+	rings map[string]*ring
+}
+
+func newHistory(size int) *history {
+	return &history{
+		size:  size,
+		rings: make(map[string]*ring),
+	}
+}
+
+// add records data for label and returns its sequence number.
+func (h *history) add(label string, data []byte) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	r, ok := h.rings[label]
+	if !ok {
+		r = &ring{buf: make([][]byte, h.size)}
+		h.rings[label] = r
+	}
+	r.add(data)
+	return h.seq
+}
+
+// replay returns a copy of the recorded messages for label, oldest first.
+// Before, it calls register with the sequence number of the latest message
+// added. No messages get added while register runs, so it mustn't block.
+func (h *history) replay(label string, register func(seq uint64)) [][]byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	register(h.seq)
+	if r, ok := h.rings[label]; ok {
+		return r.messages()
+	}
+	return nil
+}
+
+// ring is a fixed size ring buffer of messages.
+type ring struct {
+	buf  [][]byte
+	next int
+	full bool
+}
+
+func (r *ring) add(data []byte) {
+	r.buf[r.next] = data
+	r.next = (r.next + 1) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// messages returns a copy of the messages in the ring, oldest first.
+func (r *ring) messages() [][]byte {
+	if !r.full {
+		return append([][]byte(nil), r.buf[:r.next]...)
+	}
+	messages := make([][]byte, 0, len(r.buf))
+	messages = append(messages, r.buf[r.next:]...)
+	return append(messages, r.buf[:r.next]...)
+}
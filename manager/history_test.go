@@ -0,0 +1,117 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRingWraparound(t *testing.T) {
+	r := &ring{buf: make([][]byte, 3)}
+	var expected []string
+	for i := 1; i <= 7; i++ {
+		r.add([]byte(fmt.Sprint(i)))
+		expected = append(expected, fmt.Sprint(i))
+		if len(expected) > 3 {
+			expected = expected[1:]
+		}
+		var got []string
+		for _, m := range r.messages() {
+			got = append(got, string(m))
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("After adding %d messages expected %v, got %v", i, expected, got)
+		}
+	}
+}
+
+func TestRingMessagesCopied(t *testing.T) {
+	r := &ring{buf: make([][]byte, 3)}
+	r.add([]byte("a"))
+	messages := r.messages()
+	r.add([]byte("b"))
+	r.add([]byte("c"))
+	r.add([]byte("d"))
+	if len(messages) != 1 || string(messages[0]) != "a" {
+		t.Errorf("Expected messages to stay [a] after adding more, got %q", messages)
+	}
+}
+
+func TestHistoryReplay(t *testing.T) {
+	h := newHistory(2)
+	h.add("a", []byte("1"))
+	h.add("b", []byte("2"))
+	h.add("a", []byte("3"))
+	h.add("a", []byte("4"))
+	var seq uint64
+	messages := h.replay("a", func(s uint64) { seq = s })
+	if seq != 4 {
+		t.Errorf("Expected sequence number 4 across labels, got %d", seq)
+	}
+	if len(messages) != 2 || string(messages[0]) != "3" || string(messages[1]) != "4" {
+		t.Errorf("Expected [3 4], got %q", messages)
+	}
+	if messages := h.replay("missing", func(uint64) {}); messages != nil {
+		t.Errorf("Expected no messages for unknown label, got %q", messages)
+	}
+}
+
+func TestHistoryReplayDeduplicates(t *testing.T) {
+	pcs := &fakePeerConnections{}
+	pool := newTestPool(t, PoolConfig{}, WithPeerConnectionFactory(pcs.new), WithHistorySize(2))
+	for _, m := range []string{"1", "2", "3"} {
+		pool.Broadcast(context.Background(), "", "game", []byte(m))
+	}
+	if _, err := pool.NewSession(context.Background(), fakeOffer, "a", SessionConfig{}); err != nil {
+		t.Fatalf("Couldn't join: %s", err)
+	}
+	pcs.get(0).openChannel("chat") // Opens the session
+	dc := newFakeDataChannel("game")
+	dc.sent = make(chan []byte) // Blocks the replay until the test receives
+	go pcs.get(0).openDataChannel(dc)
+
+	receive := func() string {
+		t.Helper()
+		select {
+		case data := <-dc.sent:
+			return string(data)
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timeout waiting for message")
+		}
+		return ""
+	}
+	if m := receive(); m != "2" {
+		t.Fatalf("Expected replay to start with 2, got %s", m)
+	}
+
+	// Broadcasting mustn't wait for the replay, and the session must get the
+	// live message after the replay only.
+	done := make(chan struct{})
+	go func() {
+		pool.Broadcast(context.Background(), "", "game", []byte("4"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Broadcast blocked by replay")
+	}
+	for _, expected := range []string{"3", "4"} {
+		if m := receive(); m != expected {
+			t.Errorf("Expected %s, got %s", expected, m)
+		}
+	}
+
+	// Messages replayed already get skipped.
+	s := session(pool, "a")
+	if err := s.send("game", 3, []byte("3")); err != nil {
+		t.Fatalf("Couldn't send: %s", err)
+	}
+	select {
+	case m := <-dc.sent:
+		t.Errorf("Expected replayed message to be skipped, got %s", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
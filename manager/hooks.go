@@ -0,0 +1,23 @@
+package manager
+
+// SessionHooks are called on session lifecycle events, mainly so tests can
+// observe them. Unset hooks are skipped. Hooks are called from pion's
+// callbacks and must not block.
+type SessionHooks struct {
+	// OnDataChannel is called when a session accepts a datachannel.
+	OnDataChannel func(s *Session, label string)
+	// OnChannelOpen is called when an accepted datachannel opens.
+	OnChannelOpen func(s *Session, label string)
+}
+
+func (h SessionHooks) dataChannel(s *Session, label string) {
+	if h.OnDataChannel != nil {
+		h.OnDataChannel(s, label)
+	}
+}
+
+func (h SessionHooks) channelOpen(s *Session, label string) {
+	if h.OnChannelOpen != nil {
+		h.OnChannelOpen(s, label)
+	}
+}
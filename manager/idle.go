@@ -0,0 +1,97 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// reapIdleSessions periodically closes sessions which have been silent on
+// the control channel or on all data channels for longer than the
+// respective idle timeout.
+func (m *Manager) reapIdleSessions() {
+	interval := m.controlIdleTimeout
+	if interval == 0 || (m.dataIdleTimeout > 0 && m.dataIdleTimeout < interval) {
+		interval = m.dataIdleTimeout
+	}
+	interval /= 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		m.mu.RLock()
+		pools := make([]*Pool, 0, len(*m.pools))
+		for _, p := range *m.pools {
+			pools = append(pools, p)
+		}
+		m.mu.RUnlock()
+		for _, p := range pools {
+			p.closeIdleLabels(m.controlIdleTimeout, m.dataIdleTimeout)
+		}
+	}
+}
+
+// closeIdleLabels closes all sessions of the pool which haven't sent anything
+// on the control channel within control, or on any other channel within data.
+// Spectators can't send data, so only their control channel is checked. Zero
+// disables the respective check.
+func (p *Pool) closeIdleLabels(control, data time.Duration) {
+	type idleSession struct {
+		*Session
+		reason string
+		idle   time.Duration
+	}
+	p.mu.RLock()
+	sessions := make([]*Session, 0, len(*p.sessions))
+	for _, s := range *p.sessions {
+		sessions = append(sessions, s)
+	}
+	p.mu.RUnlock()
+	var idle []idleSession
+	for _, s := range sessions {
+		controlIdle, dataIdle := s.idleDurations()
+		switch {
+		case control > 0 && controlIdle > control:
+			idle = append(idle, idleSession{s, "control_idle", controlIdle})
+		case data > 0 && dataIdle > data && !s.config.Spectator:
+			idle = append(idle, idleSession{s, "data_idle", dataIdle})
+		}
+	}
+	for _, s := range idle {
+		level.Info(s.logger).Log("msg", "Closing idle session", "reason", s.reason, "idle", s.idle)
+		if err := p.closeSession(s.Session, s.reason); err != nil {
+			level.Warn(s.logger).Log("msg", "Couldn't close session", "error", err)
+		}
+	}
+}
+
+// touch records activity on label.
+func (p *Session) touch(label string) {
+	p.mu.Lock()
+	p.lastActivity[label] = time.Now()
+	p.mu.Unlock()
+}
+
+// idleDurations returns for how long the session hasn't sent anything on the
+// control channel and on any of the other channels. Sessions count as active
+// on all labels when created.
+func (p *Session) idleDurations() (control, data time.Duration) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	lastControl, lastData := p.created, p.created
+	for label, t := range p.lastActivity {
+		if label == p.controlLabel {
+			lastControl = t
+		} else if t.After(lastData) {
+			lastData = t
+		}
+	}
+	return time.Since(lastControl), time.Since(lastData)
+}
@@ -0,0 +1,56 @@
+package manager
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCloseIdleLabels(t *testing.T) {
+	pcs := &fakePeerConnections{}
+	pool := newTestPool(t, PoolConfig{}, WithPeerConnectionFactory(pcs.new))
+	pcs.join(t, pool, SessionConfig{}, "game", "new", "active", "control-idle", "data-idle")
+	pcs.join(t, pool, SessionConfig{Spectator: true}, "game", "spectator")
+
+	past := time.Now().Add(-time.Hour)
+	for id, activity := range map[string]map[string]time.Time{
+		"active":       {defaultControlLabel: time.Now(), "game": time.Now()},
+		"control-idle": {defaultControlLabel: past, "game": time.Now()},
+		"data-idle":    {defaultControlLabel: time.Now(), "game": past},
+		"spectator":    {defaultControlLabel: time.Now()},
+	} {
+		s := session(pool, id)
+		s.mu.Lock()
+		s.created = past
+		s.lastActivity = activity
+		s.mu.Unlock()
+	}
+
+	pool.closeIdleLabels(time.Minute, time.Minute)
+	for id, open := range map[string]bool{
+		"new":          true,
+		"active":       true,
+		"control-idle": false,
+		"data-idle":    false,
+		"spectator":    true,
+	} {
+		if s := session(pool, id); (s != nil) != open {
+			t.Errorf("Expected session %s to be open: %t", id, open)
+		}
+	}
+}
+
+func TestCloseIdleLabelsDisabled(t *testing.T) {
+	pcs := &fakePeerConnections{}
+	pool := newTestPool(t, PoolConfig{}, WithPeerConnectionFactory(pcs.new))
+	pcs.join(t, pool, SessionConfig{}, "game", "idle")
+	s := session(pool, "idle")
+	s.mu.Lock()
+	s.created = time.Now().Add(-time.Hour)
+	s.lastActivity = map[string]time.Time{}
+	s.mu.Unlock()
+
+	pool.closeIdleLabels(0, 0)
+	if session(pool, "idle") == nil {
+		t.Error("Expected zero timeouts to disable closing idle sessions")
+	}
+}
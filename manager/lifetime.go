@@ -0,0 +1,61 @@
+package manager
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// reapSessions periodically ends sessions older than the maximum session
+// lifetime, regardless of their activity.
+func (m *Manager) reapSessions() {
+	interval := m.maxSessionLifetime / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		m.mu.RLock()
+		pools := make([]*Pool, 0, len(*m.pools))
+		for _, p := range *m.pools {
+			pools = append(pools, p)
+		}
+		m.mu.RUnlock()
+		for _, p := range pools {
+			p.endExpiredSessions(m.maxSessionLifetime)
+		}
+	}
+}
+
+// endExpiredSessions closes all sessions of the pool created more than
+// lifetime ago. Before, an ended event is sent to the session. The others get
+// the leave event sent when closing it.
+func (p *Pool) endExpiredSessions(lifetime time.Duration) {
+	p.mu.RLock()
+	var expired []*Session
+	for _, s := range *p.sessions {
+		if time.Since(s.created) > lifetime {
+			expired = append(expired, s)
+		}
+	}
+	p.mu.RUnlock()
+	for _, s := range expired {
+		level.Info(s.logger).Log("msg", "Ending session after maximum lifetime", "lifetime", lifetime)
+		data, err := json.Marshal(controlEvent{Event: "ended", ID: s.ID})
+		if err != nil {
+			level.Error(s.logger).Log("msg", "Couldn't encode control event", "error", err)
+		} else if err := s.send(p.controlLabel, 0, data); err != nil {
+			level.Debug(s.logger).Log("msg", "Couldn't send ended event", "error", err)
+		}
+		if err := p.closeSession(s, "lifetime_exceeded"); err != nil {
+			level.Warn(s.logger).Log("msg", "Couldn't close session", "error", err)
+		}
+	}
+}
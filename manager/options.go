@@ -0,0 +1,260 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// ManagerOption configures a Manager.
+type ManagerOption func(*Manager)
+
+// WithSendQueueSize sets the number of messages queued for sending to a
+// session. Once its queue is full, further messages to it get dropped. Values
+// below 1 are raised to 1.
+func WithSendQueueSize(n int) ManagerOption {
+	return func(m *Manager) {
+		m.sendQueueSize = n
+	}
+}
+
+// WithMaxBufferedAmount sets the number of bytes that may be queued on a
+// datachannel before further messages to it get dropped. Zero disables the
+// limit.
+func WithMaxBufferedAmount(n uint64) ManagerOption {
+	return func(m *Manager) {
+		m.maxBufferedAmount = n
+	}
+}
+
+// WithMaxSendFailures sets the number of consecutive failed sends after which
+// a session gets closed. Zero disables closing sessions on send failures.
+func WithMaxSendFailures(n int) ManagerOption {
+	return func(m *Manager) {
+		m.maxSendFailures = n
+	}
+}
+
+// WithLogSampleRate sets the fraction of sent messages, between 0 and 1,
+// whose payload gets logged at debug level.
+func WithLogSampleRate(rate float64) ManagerOption {
+	return func(m *Manager) {
+		m.logSampleRate = rate
+	}
+}
+
+// WithControlLabel sets the label of the datachannel the server creates for
+// control events like sessions joining and leaving a pool.
+func WithControlLabel(label string) ManagerOption {
+	return func(m *Manager) {
+		m.controlLabel = label
+	}
+}
+
+// WithHistorySize sets the number of broadcast messages per label a pool keeps
+// to replay to sessions joining later. Zero disables the history.
+func WithHistorySize(n int) ManagerOption {
+	return func(m *Manager) {
+		m.historySize = n
+	}
+}
+
+// WithMaxMessageSize sets the maximum size in bytes of a message received
+// from a session. Larger messages get dropped. Zero disables the limit.
+func WithMaxMessageSize(n int) ManagerOption {
+	return func(m *Manager) {
+		m.maxMessageSize = n
+	}
+}
+
+// WithMaxOversizedMessages sets the number of oversized messages after which
+// the sending session gets closed. Zero disables closing sessions for sending
+// oversized messages.
+func WithMaxOversizedMessages(n int) ManagerOption {
+	return func(m *Manager) {
+		m.maxOversized = n
+	}
+}
+
+// WithDirectLabel sets the datachannel label reserved for direct messages
+// between two sessions. Messages on it are of the form "<id>\n<payload>". The
+// server delivers them only to the session with the given id, replacing the
+// id with the one of the sender.
+func WithDirectLabel(label string) ManagerOption {
+	return func(m *Manager) {
+		m.directLabel = label
+	}
+}
+
+// WithLabels sets the datachannel labels with their delivery semantics. The
+// server creates a datachannel for each of them when a session is created.
+func WithLabels(labels map[string]LabelConfig) ManagerOption {
+	return func(m *Manager) {
+		m.labels = labels
+	}
+}
+
+// WithStatsInterval sets the interval in which the connection stats of
+// sessions get collected. Zero disables stats collection.
+func WithStatsInterval(d time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.statsInterval = d
+	}
+}
+
+// WithICEServers sets the ICE servers used by the peer connections of all
+// pools.
+func WithICEServers(servers []webrtc.ICEServer) ManagerOption {
+	return func(m *Manager) {
+		m.iceServers = servers
+	}
+}
+
+// WithRelayOnly restricts the peer connections of all pools to TURN relays.
+func WithRelayOnly(relayOnly bool) ManagerOption {
+	return func(m *Manager) {
+		m.relayOnly = relayOnly
+	}
+}
+
+// WithPoolRegistry sets the registry pools get registered in, e.g. one shared
+// by multiple server instances. It defaults to an in-memory registry, which is
+// also kept if r is nil.
+func WithPoolRegistry(r PoolRegistry) ManagerOption {
+	return func(m *Manager) {
+		if r != nil {
+			m.registry = r
+		}
+	}
+}
+
+// WithMessageBus relays broadcasts between instances through bus, so
+// sessions of a pool can be connected to different instances. Pools hosted by
+// other nodes get mirrored locally when they're joined.
+func WithMessageBus(bus MessageBus) ManagerOption {
+	return func(m *Manager) {
+		m.bus = bus
+	}
+}
+
+// WithNodeID sets the id this instance registers its pools with in the pool
+// registry.
+func WithNodeID(id string) ManagerOption {
+	return func(m *Manager) {
+		m.nodeID = id
+	}
+}
+
+// WithMaxPoolLabels limits the number of distinct pool label values of
+// metrics. Pools past the limit share the label value "_other". Zero means
+// unlimited.
+func WithMaxPoolLabels(n int) ManagerOption {
+	return func(m *Manager) {
+		m.poolLabels = newPoolLabels(n)
+	}
+}
+
+// WithMaxPools sets the maximum number of pools. Zero means unlimited.
+func WithMaxPools(n int) ManagerOption {
+	return func(m *Manager) {
+		m.maxPools = n
+	}
+}
+
+// WithMaxSessionLifetime sets the duration after which sessions get closed,
+// even if they're active. Zero means unlimited.
+func WithMaxSessionLifetime(d time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.maxSessionLifetime = d
+	}
+}
+
+// WithIdleTimeouts sets the durations after which sessions get closed that
+// haven't sent anything on the control channel, respectively on any other
+// channel. Keeping them separate allows spectators and quiet phases of a game
+// while still detecting clients that went away. Zero disables the check.
+func WithIdleTimeouts(control, data time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.controlIdleTimeout = control
+		m.dataIdleTimeout = data
+	}
+}
+
+// WithPoolTTL sets the duration after which pools without sessions get
+// closed. Zero disables closing empty pools.
+func WithPoolTTL(d time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.poolTTL = d
+	}
+}
+
+// WithIDGenerator sets the function used to generate ids, e.g. to make them
+// predictable in tests or shorter using NewIDGenerator.
+func WithIDGenerator(f IDGenerator) ManagerOption {
+	return func(m *Manager) {
+		m.idGenerator = f
+	}
+}
+
+// WithPeerConnectionFactory sets the function used to create the peer
+// connections of sessions, e.g. to replace them with fakes in tests.
+func WithPeerConnectionFactory(f PeerConnectionFactory) ManagerOption {
+	return func(m *Manager) {
+		m.newPeerConnection = f
+	}
+}
+
+// WithWebRTCAPI makes sessions create their peer connections with api, e.g.
+// to apply the settings of a webrtc.SettingEngine.
+func WithWebRTCAPI(api *webrtc.API) ManagerOption {
+	return func(m *Manager) {
+		m.newPeerConnection = func(config webrtc.Configuration) (PeerConnection, error) {
+			pc, err := api.NewPeerConnection(config)
+			if err != nil {
+				return nil, err
+			}
+			return pionPeerConnection{pc}, nil
+		}
+	}
+}
+
+// WithMessageValidator sets the validator all messages received by sessions
+// are passed through before they get relayed.
+func WithMessageValidator(v MessageValidator) ManagerOption {
+	return func(m *Manager) {
+		m.validateMessage = v
+	}
+}
+
+// WithQueueSize sets how many clients may wait for a slot in a full pool.
+// Past that, the oldest waiters get dropped.
+func WithQueueSize(n int) ManagerOption {
+	return func(m *Manager) {
+		m.queueSize = n
+	}
+}
+
+// WithSessionHooks sets hooks called on session lifecycle events.
+func WithSessionHooks(h SessionHooks) ManagerOption {
+	return func(m *Manager) {
+		m.hooks = h
+	}
+}
+
+// WithGatheringTimeout sets how long to wait for ICE candidate gathering to
+// complete before answering with the candidates gathered so far.
+func WithGatheringTimeout(d time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.gatheringTimeout = d
+	}
+}
+
+// WithHeartbeat makes sessions send a ping event on the control channel every
+// interval and close sessions whose client doesn't answer with a pong event
+// within timeout. Zero interval disables the heartbeat.
+func WithHeartbeat(interval, timeout time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.heartbeatInterval = interval
+		m.heartbeatTimeout = timeout
+	}
+}
@@ -0,0 +1,62 @@
+package manager
+
+import "github.com/pion/webrtc/v3"
+
+// PeerConnection is the subset of *webrtc.PeerConnection used by sessions.
+type PeerConnection interface {
+	SetRemoteDescription(webrtc.SessionDescription) error
+	CreateAnswer(*webrtc.AnswerOptions) (webrtc.SessionDescription, error)
+	SetLocalDescription(webrtc.SessionDescription) error
+	LocalDescription() *webrtc.SessionDescription
+	ICEGatheringState() webrtc.ICEGatheringState
+	CreateDataChannel(string, *webrtc.DataChannelInit) (DataChannel, error)
+	GetStats() webrtc.StatsReport
+	Close() error
+	OnDataChannel(func(DataChannel))
+	OnConnectionStateChange(func(webrtc.PeerConnectionState))
+	OnICEGatheringStateChange(func(webrtc.ICEGathererState))
+}
+
+// DataChannel is the subset of *webrtc.DataChannel used by sessions.
+type DataChannel interface {
+	Label() string
+	ID() *uint16
+	Ordered() bool
+	ReadyState() webrtc.DataChannelState
+	BufferedAmount() uint64
+	Send([]byte) error
+	Close() error
+	OnOpen(func())
+	OnClose(func())
+	OnMessage(func(webrtc.DataChannelMessage))
+}
+
+// PeerConnectionFactory creates a PeerConnection with the given configuration.
+type PeerConnectionFactory func(webrtc.Configuration) (PeerConnection, error)
+
+// newPeerConnection is the default PeerConnectionFactory creating pion peer
+// connections.
+func newPeerConnection(config webrtc.Configuration) (PeerConnection, error) {
+	pc, err := webrtc.NewPeerConnection(config)
+	if err != nil {
+		return nil, err
+	}
+	return pionPeerConnection{pc}, nil
+}
+
+// pionPeerConnection adapts *webrtc.PeerConnection to PeerConnection.
+type pionPeerConnection struct {
+	*webrtc.PeerConnection
+}
+
+func (pc pionPeerConnection) CreateDataChannel(label string, init *webrtc.DataChannelInit) (DataChannel, error) {
+	dc, err := pc.PeerConnection.CreateDataChannel(label, init)
+	if err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+func (pc pionPeerConnection) OnDataChannel(f func(DataChannel)) {
+	pc.PeerConnection.OnDataChannel(func(dc *webrtc.DataChannel) { f(dc) })
+}
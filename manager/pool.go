@@ -1,76 +1,417 @@
 package manager
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"math/rand"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pion/webrtc/v3"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 
+	"github.com/discordianfish/infisk8-server/tracing"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 )
 
 const (
 	idLen = 32
+
+	// minIDEntropy is the minimum number of random bits of generated ids.
+	minIDEntropy = 64
+
+	defaultSendQueueSize     = 256
+	defaultMaxBufferedAmount = 1 << 20
+	defaultMaxSendFailures   = 10
+	defaultLogSampleRate     = 0.01
+	defaultControlLabel      = "control"
+	defaultDirectLabel       = "direct"
+	defaultMaxMessageSize    = 64 << 10
+	defaultStatsInterval     = 15 * time.Second
+	defaultGatheringTimeout  = 5 * time.Second
+	defaultQueueSize         = 100
+	defaultMaxPoolLabels     = 100
+	defaultMetricsNamespace  = "infisk8"
+
+	instrumentationName = "github.com/discordianfish/infisk8-server/manager"
 )
 
+var defaultICEServers = []webrtc.ICEServer{
+	{
+		URLs: []string{"stun:stun.l.google.com:19302"},
+	},
+}
+
 var (
-	letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	genID   = newIDGenerator([]rune(letters), idLen)
+
+	sessionGauge            prometheus.Gauge
+	sessionsClosedCounter   *prometheus.CounterVec
+	dataChannelGauge        prometheus.Gauge
+	poolGauge               prometheus.Gauge
+	poolsCreatedCounter     prometheus.Counter
+	poolsDeletedCounter     prometheus.Counter
+	messageSentCounter      prometheus.Counter
+	messageReceivedCounter  prometheus.Counter
+	messageDroppedCounter   *prometheus.CounterVec
+	messageOversizedCounter prometheus.Counter
+	compressionSavedCounter prometheus.Counter
+	messageSize             prometheus.Histogram
+	broadcastFanout         prometheus.Histogram
+	sendQueueLength         prometheus.Histogram
+	sessionDuration         prometheus.Histogram
+	rttGauge                *prometheus.GaugeVec
+	lossGauge               *prometheus.GaugeVec
+
+	metrics []prometheus.Collector // Registered metrics of the package
+)
+
+func init() {
+	SetMetricsNamespace(defaultMetricsNamespace, "")
+}
 
+// SetMetricsNamespace replaces the metrics of the package by ones with the
+// given Prometheus namespace and subsystem. It must be called before creating
+// a manager.
+func SetMetricsNamespace(namespace, subsystem string) {
+	for _, c := range metrics {
+		prometheus.Unregister(c)
+	}
 	sessionGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "infisk8_sessions",
-		Help: "Current number of sessions",
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "sessions",
+		Help:      "Current number of sessions",
+	})
+
+	sessionsClosedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "sessions_closed_total",
+		Help:      "Total number of sessions closed",
+	}, []string{"reason"})
+
+	dataChannelGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "datachannels",
+		Help:      "Current number of open datachannels",
 	})
 
 	poolGauge = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "infisk8_pools",
-		Help: "Current number of pools",
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "pools",
+		Help:      "Current number of pools",
+	})
+
+	poolsCreatedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "pools_created_total",
+		Help:      "Total number of pools created",
+	})
+
+	poolsDeletedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "pools_deleted_total",
+		Help:      "Total number of pools deleted",
 	})
 
 	messageSentCounter = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: "infisk8_messages_sent_total",
-		Help: "Total number of messages sent",
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "messages_sent_total",
+		Help:      "Total number of messages sent",
 	})
 
 	messageReceivedCounter = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: "infisk8_messages_received_total",
-		Help: "Total number of messages received",
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "messages_received_total",
+		Help:      "Total number of messages received",
 	})
-)
 
-func init() {
-	prometheus.MustRegister(sessionGauge)
-	prometheus.MustRegister(poolGauge)
-	prometheus.MustRegister(messageSentCounter)
-	prometheus.MustRegister(messageReceivedCounter)
+	messageDroppedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "messages_dropped_total",
+		Help:      "Total number of messages dropped",
+	}, []string{"reason"})
+
+	messageOversizedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "messages_oversized_total",
+		Help:      "Total number of received messages dropped for exceeding the maximum message size",
+	})
+
+	compressionSavedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "compression_saved_bytes_total",
+		Help:      "Total number of bytes saved by compressing broadcast messages",
+	})
+
+	messageSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "message_size_bytes",
+		Help:      "Size of received messages",
+		Buckets:   prometheus.ExponentialBuckets(16, 4, 8), // 16B to 256KB
+	})
+
+	broadcastFanout = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "broadcast_fanout",
+		Help:      "Number of sessions a broadcast is sent to",
+		Buckets:   []float64{0, 1, 2, 4, 8, 16, 32, 64, 128, 256},
+	})
+
+	sendQueueLength = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "send_queue_length",
+		Help:      "Number of messages in the send queue of a session when queueing another one",
+		Buckets:   []float64{0, 1, 2, 4, 8, 16, 32, 64, 128, 256},
+	})
+
+	sessionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "session_duration_seconds",
+		Help:      "Duration of closed sessions",
+		Buckets:   []float64{10, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200},
+	})
+
+	rttGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "rtt_seconds",
+		Help:      "Average round trip time of the sessions in a pool",
+	}, []string{"pool"})
+
+	lossGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "stun_loss_ratio",
+		Help:      "Average ratio of unanswered STUN requests of the sessions in a pool",
+	}, []string{"pool"})
+
+	metrics = []prometheus.Collector{
+		sessionGauge,
+		sessionsClosedCounter,
+		dataChannelGauge,
+		poolGauge,
+		poolsCreatedCounter,
+		poolsDeletedCounter,
+		messageSentCounter,
+		messageReceivedCounter,
+		messageDroppedCounter,
+		messageOversizedCounter,
+		compressionSavedCounter,
+		messageSize,
+		broadcastFanout,
+		sendQueueLength,
+		sessionDuration,
+		rttGauge,
+		lossGauge,
+	}
+	for _, c := range metrics {
+		prometheus.MustRegister(c)
+	}
+}
+
+// MessageValidator checks a message received on label before it gets
+// relayed. If it returns an error, the message gets dropped, otherwise the
+// returned data gets relayed instead, allowing validators to transform
+// messages.
+type MessageValidator func(label string, data []byte) ([]byte, error)
+
+func noopValidator(label string, data []byte) ([]byte, error) {
+	return data, nil
 }
 
-func genID() string {
-	c := make([]rune, idLen)
-	for i := range c {
-		c[i] = letters[rand.Intn(len(letters))]
+// IDGenerator returns a new unique id.
+type IDGenerator func() string
+
+// NewIDGenerator returns an IDGenerator generating random ids of the given
+// length from the characters in alphabet. The characters must be unique and
+// the ids have at least 64 bits of entropy.
+func NewIDGenerator(alphabet string, length int) (IDGenerator, error) {
+	runes := []rune(alphabet)
+	seen := make(map[rune]bool, len(runes))
+	for _, r := range runes {
+		if seen[r] {
+			return nil, fmt.Errorf("Duplicate character %q in id alphabet", r)
+		}
+		seen[r] = true
+	}
+	if len(runes) < 2 {
+		return nil, fmt.Errorf("Id alphabet must have at least 2 characters")
+	}
+	if bits := float64(length) * math.Log2(float64(len(runes))); bits < minIDEntropy {
+		return nil, fmt.Errorf("Ids of length %d from %d characters have %.0f bits of entropy, at least %d required", length, len(runes), bits, minIDEntropy)
+	}
+	return newIDGenerator(runes, length), nil
+}
+
+func newIDGenerator(alphabet []rune, length int) IDGenerator {
+	return func() string {
+		c := make([]rune, length)
+		for i := range c {
+			c[i] = alphabet[rand.Intn(len(alphabet))]
+		}
+		return string(c)
+	}
+}
+
+// recoverPanic recovers from a panic and logs it along with the stack trace.
+// It must be called directly by defer.
+func recoverPanic(logger log.Logger) {
+	if r := recover(); r != nil {
+		level.Error(logger).Log("msg", "Recovered from panic", "panic", r, "stack", string(debug.Stack()))
 	}
-	return string(c)
 }
 
 // Manager manages pools
 type Manager struct {
 	logger log.Logger
-	pools  *map[string]*Pool
+
+	mu    sync.RWMutex // protects pools
+	pools *map[string]*Pool
+
+	draining int32 // Accessed atomically, 1 if draining
+
+	ctx    context.Context // cancelled on shutdown
+	cancel context.CancelFunc
+
+	registry PoolRegistry
+	bus      MessageBus // nil if disabled
+	nodeID   string
+
+	iceServers         []webrtc.ICEServer
+	relayOnly          bool
+	maxPools           int
+	poolTTL            time.Duration
+	maxSessionLifetime time.Duration
+	controlIdleTimeout time.Duration
+	dataIdleTimeout    time.Duration
+	idGenerator        IDGenerator
+	newPeerConnection  PeerConnectionFactory
+	sendQueueSize      int
+	maxBufferedAmount  uint64
+	maxSendFailures    int
+	logSampleRate      float64
+	controlLabel       string
+	historySize        int
+	queueSize          int
+	poolLabels         *poolLabels
+	maxMessageSize     int
+	maxOversized       int
+	directLabel        string
+	labels             map[string]LabelConfig
+	statsInterval      time.Duration
+	gatheringTimeout   time.Duration
+	heartbeatInterval  time.Duration
+	heartbeatTimeout   time.Duration
+	validateMessage    MessageValidator
+	hooks              SessionHooks
+}
+
+// LabelConfig configures the delivery semantics of the datachannels with a
+// given label.
+type LabelConfig struct {
+	Ordered bool
+	// MaxRetransmits limits how often a message gets retransmitted. Nil means
+	// reliable delivery.
+	MaxRetransmits *uint16
+	// CoalesceInterval, if set, makes the server only broadcast the latest
+	// message each session sent on the label within the interval. Older
+	// messages get dropped.
+	CoalesceInterval time.Duration
+}
+
+// Reliable reports whether messages on the label get delivered reliably.
+// Messages on unreliable labels may be dropped under backpressure and failing
+// to send them doesn't count towards closing a session.
+func (c LabelConfig) Reliable() bool {
+	return c.MaxRetransmits == nil
 }
 
-func NewManager(logger log.Logger) *Manager {
+func NewManager(logger log.Logger, opts ...ManagerOption) *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
 	m := &Manager{
-		logger: logger,
-		pools:  &map[string]*Pool{},
+		ctx:               ctx,
+		cancel:            cancel,
+		logger:            logger,
+		pools:             &map[string]*Pool{},
+		registry:          newMemoryRegistry(),
+		validateMessage:   noopValidator,
+		iceServers:        defaultICEServers,
+		idGenerator:       genID,
+		newPeerConnection: newPeerConnection,
+		sendQueueSize:     defaultSendQueueSize,
+		maxBufferedAmount: defaultMaxBufferedAmount,
+		maxSendFailures:   defaultMaxSendFailures,
+		logSampleRate:     defaultLogSampleRate,
+		controlLabel:      defaultControlLabel,
+		maxMessageSize:    defaultMaxMessageSize,
+		directLabel:       defaultDirectLabel,
+		statsInterval:     defaultStatsInterval,
+		gatheringTimeout:  defaultGatheringTimeout,
+		queueSize:         defaultQueueSize,
+		poolLabels:        newPoolLabels(defaultMaxPoolLabels),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.sendQueueSize < 1 {
+		m.sendQueueSize = 1
+	}
+	if m.poolTTL > 0 {
+		go m.reapPools()
+	}
+	if m.maxSessionLifetime > 0 {
+		go m.reapSessions()
+	}
+	if m.controlIdleTimeout > 0 || m.dataIdleTimeout > 0 {
+		go m.reapIdleSessions()
 	}
-	// FIXME: Remove
-	m.NewPool("test")
 	return m
 }
 
+// NewID returns a new id from the manager's IDGenerator.
+func (m *Manager) NewID() string {
+	return m.idGenerator()
+}
+
+// Pools returns the names of all pools in the registry, including those
+// hosted by other nodes.
 func (m *Manager) Pools() []string {
+	names, err := m.registry.Pools()
+	if err == nil {
+		return names
+	}
+	level.Warn(m.logger).Log("msg", "Couldn't list pools from registry, listing local pools only", "error", err)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	ps := make([]string, len(*m.pools))
 	i := 0
 	for n, _ := range *m.pools {
@@ -80,160 +421,1521 @@ func (m *Manager) Pools() []string {
 	return ps
 }
 
-// Retrieves pool by name, returns error if not found.
+// Sessions returns information about the sessions of all pools.
+func (m *Manager) Sessions() []SessionInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	infos := []SessionInfo{}
+	for _, p := range *m.pools {
+		infos = append(infos, p.Sessions()...)
+	}
+	return infos
+}
+
+// PoolInfos returns information about the pools hosted by this node.
+func (m *Manager) PoolInfos() []PoolInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	infos := make([]PoolInfo, 0, len(*m.pools))
+	for _, p := range *m.pools {
+		infos = append(infos, p.Info())
+	}
+	return infos
+}
+
+// Retrieves pool by name, returns error if not found. If the pool is hosted
+// by another node and not mirrored locally, a *RemotePoolError is returned.
 func (m *Manager) Pool(name string) (*Pool, error) {
+	p, _, err := m.lookupPool(name)
+	return p, err
+}
+
+// JoinPool retrieves the pool name to join it. Unlike Pool, a pool hosted by
+// another node gets mirrored locally if a message bus is configured.
+func (m *Manager) JoinPool(name string) (*Pool, error) {
+	p, record, err := m.lookupPool(name)
+	var rerr *RemotePoolError
+	if m.bus != nil && errors.As(err, &rerr) {
+		return m.mirrorPool(name, record.Config)
+	}
+	return p, err
+}
+
+// lookupPool returns the local pool name or, if it's hosted by another node,
+// its registry record along with a *RemotePoolError.
+func (m *Manager) lookupPool(name string) (*Pool, PoolRecord, error) {
+	if p, ok := m.LocalPool(name); ok {
+		return p, PoolRecord{}, nil
+	}
+	record, ok, err := m.registry.Lookup(name)
+	if err != nil {
+		return nil, record, fmt.Errorf("Couldn't look up pool %s: %w", name, err)
+	}
+	if ok && record.Node != m.nodeID {
+		return nil, record, &RemotePoolError{Name: name, Node: record.Node}
+	}
+	return nil, record, fmt.Errorf("Couldn't find pool with name %s", name)
+}
+
+// LocalPool returns the pool name if it's hosted or mirrored by this node.
+// Unlike Pool, it neither consults the registry nor allocates an error.
+func (m *Manager) LocalPool(name string) (*Pool, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	p, ok := (*m.pools)[name]
-	if !ok {
-		return nil, fmt.Errorf("Couldn't find pool with name %s", name)
+	return p, ok
+}
+
+// PoolExists reports whether a pool with the given name exists on this or,
+// according to the registry, another node. Unlike Pool, it doesn't allocate
+// an error. Registry errors count as not existing.
+func (m *Manager) PoolExists(name string) bool {
+	if _, ok := m.LocalPool(name); ok {
+		return true
 	}
-	return p, nil
+	_, ok, err := m.registry.Lookup(name)
+	return ok && err == nil
+}
+
+// PoolConfig holds the settings of a pool provided when creating it.
+type PoolConfig struct {
+	// RelayOnly restricts the peer connections of the pool to TURN relays so
+	// peer IPs aren't exposed. It's always set if the manager is configured
+	// with WithRelayOnly.
+	RelayOnly bool `json:"relayOnly"`
+
+	// Compress enables compressing broadcast messages, except on the control
+	// label, for sessions which joined with compression enabled.
+	Compress bool `json:"compress"`
+
+	// Topology is either TopologyMesh, the default, or TopologyStar.
+	Topology string `json:"topology"`
+
+	// Echo sends messages back to the session that sent them instead of
+	// relaying them to others, to test the connectivity of clients.
+	Echo bool `json:"echo"`
+
+	// AllowedLabels restricts the labels of datachannels clients may open,
+	// besides the control, direct and configured labels. If empty, all
+	// labels are allowed.
+	AllowedLabels []string `json:"allowedLabels,omitempty"`
+
+	// AnswerOptions are passed to CreateAnswer when answering offers of
+	// sessions. Nil uses pion's defaults.
+	AnswerOptions *webrtc.AnswerOptions `json:"answerOptions,omitempty"`
+
+	// Channels overrides the settings of the datachannels the server creates
+	// for each session by label. Only the control label and the labels
+	// configured on the manager can be overridden and Negotiated and ID must
+	// be unset. The control channel defaults to ordered and reliable, the
+	// others to their label config. Unset Ordered means ordered.
+	Channels map[string]webrtc.DataChannelInit `json:"channels,omitempty"`
+
+	// MaxSessions limits the number of sessions in the pool. Zero means no
+	// limit.
+	MaxSessions int `json:"maxSessions,omitempty"`
+
+	// BinaryFraming routes binary messages by their first byte instead of
+	// their label, so clients can use a single channel for broadcasts,
+	// unicasts and control messages. Text messages are unaffected.
+	BinaryFraming bool `json:"binaryFraming"`
+}
+
+// labelAllowed returns whether sessions may use datachannels with label.
+func (p *Pool) labelAllowed(label string) bool {
+	return p.allowedLabels == nil || p.allowedLabels[label]
+}
+
+// hasTURNServer returns whether any of servers is a TURN server.
+func hasTURNServer(servers []webrtc.ICEServer) bool {
+	for _, s := range servers {
+		for _, u := range s.URLs {
+			if strings.HasPrefix(u, "turn:") || strings.HasPrefix(u, "turns:") {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-func (m *Manager) NewPool(name string) (*Pool, error) {
+func (m *Manager) NewPool(name string, config PoolConfig) (*Pool, error) {
+	if m.Draining() {
+		return nil, ErrDraining
+	}
+	if name == poolLabelOther {
+		return nil, fmt.Errorf("Couldn't create pool %s: %w", name, ErrInvalidPoolName)
+	}
+	config, policy, err := m.checkPoolConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	_, ok := (*m.pools)[name]
 	if ok {
-		return nil, fmt.Errorf("Pool with name %s already exists", name)
+		return nil, fmt.Errorf("Couldn't create pool %s: %w", name, ErrPoolExists)
+	}
+	if m.maxPools > 0 && m.hostedPools() >= m.maxPools {
+		return nil, ErrTooManyPools
+	}
+	if err := m.registry.Register(name, PoolRecord{Node: m.nodeID, Config: config}); err != nil {
+		return nil, err
+	}
+	p := m.newPool(name, policy, config)
+	if m.bus != nil {
+		if err := p.subscribe(); err != nil {
+			m.registry.Deregister(name)
+			m.poolLabels.release(name)
+			return nil, fmt.Errorf("Couldn't subscribe to pool %s: %w", name, err)
+		}
+	}
+	m.addPool(p)
+	return p, nil
+}
+
+// checkPoolConfig validates config and returns it with defaults applied,
+// along with the ICE transport policy of the pool.
+func (m *Manager) checkPoolConfig(config PoolConfig) (PoolConfig, webrtc.ICETransportPolicy, error) {
+	policy := webrtc.ICETransportPolicyAll
+	switch config.Topology {
+	case "":
+		config.Topology = TopologyMesh
+	case TopologyMesh, TopologyStar:
+	default:
+		return config, policy, fmt.Errorf("%w: invalid topology %q", ErrInvalidPoolConfig, config.Topology)
+	}
+	if err := m.validateChannels(config.Channels); err != nil {
+		return config, policy, err
+	}
+	if config.RelayOnly || m.relayOnly {
+		if !hasTURNServer(m.iceServers) {
+			return config, policy, fmt.Errorf("%w: relay only pools require a TURN server", ErrInvalidPoolConfig)
+		}
+		policy = webrtc.ICETransportPolicyRelay
+	}
+	return config, policy, nil
+}
+
+// hostedPools returns the number of pools hosted by this node, not counting
+// mirrors of pools hosted by others. The caller must hold m.mu.
+func (m *Manager) hostedPools() int {
+	n := 0
+	for _, p := range *m.pools {
+		if !p.mirror {
+			n++
+		}
+	}
+	return n
+}
+
+// mirrorPool returns the local pool for the pool name hosted by another node,
+// creating it with the config of the hosting node if necessary. Broadcasts
+// get relayed to the other nodes by the message bus. Mirrors don't count
+// towards the maximum number of pools since they're limited by the pools of
+// the other nodes.
+func (m *Manager) mirrorPool(name string, config PoolConfig) (*Pool, error) {
+	if m.Draining() {
+		return nil, ErrDraining
+	}
+	m.mu.RLock()
+	p, ok := (*m.pools)[name]
+	m.mu.RUnlock()
+	if ok {
+		return p, nil
 	}
+	config, policy, err := m.checkPoolConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't mirror pool %s: %w", name, err)
+	}
+	p = m.newPool(name, policy, config)
+	p.mirror = true
+	if err := p.subscribe(); err != nil {
+		m.poolLabels.release(name)
+		return nil, fmt.Errorf("Couldn't subscribe to pool %s: %w", name, err)
+	}
+	m.mu.Lock()
+	if existing, ok := (*m.pools)[name]; ok { // Mirrored concurrently
+		m.mu.Unlock()
+		p.unsubscribe()
+		return existing, nil
+	}
+	m.addPool(p)
+	m.mu.Unlock()
+	level.Info(m.logger).Log("msg", "Mirroring remote pool", "pool", name)
+	return p, nil
+}
+
+// newPool returns a pool configured by the manager.
+func (m *Manager) newPool(name string, policy webrtc.ICETransportPolicy, config PoolConfig) *Pool {
 	p := &Pool{
+		name:   name,
 		logger: log.With(m.logger, "pool", name),
 		config: webrtc.Configuration{
-			ICEServers: []webrtc.ICEServer{
-				{
-					URLs: []string{"stun:stun.l.google.com:19302"},
-				},
-			},
+			ICEServers:         m.iceServers,
+			ICETransportPolicy: policy,
 		},
-		sessions: &map[string]*Session{},
+		newPeerConnection: m.newPeerConnection,
+		emptySince:        time.Now(),
+		sessions:          &map[string]*Session{},
+		sendQueueSize:     m.sendQueueSize,
+		maxBufferedAmount: m.maxBufferedAmount,
+		maxSendFailures:   m.maxSendFailures,
+		logSampler:        newSampler(m.logSampleRate),
+		controlLabel:      m.controlLabel,
+		maxMessageSize:    m.maxMessageSize,
+		maxOversized:      m.maxOversized,
+		directLabel:       m.directLabel,
+		labels:            m.labels,
+		statsInterval:     m.statsInterval,
+		gatheringTimeout:  m.gatheringTimeout,
+		heartbeatInterval: m.heartbeatInterval,
+		heartbeatTimeout:  m.heartbeatTimeout,
+		compress:          config.Compress,
+		topology:          config.Topology,
+		answerOptions:     config.AnswerOptions,
+		echo:              config.Echo,
+		created:           time.Now(),
+		bus:               m.bus,
+		nodeID:            m.nodeID,
+		draining:          m.Draining,
+		ctx:               m.ctx,
+		validateMessage:   m.validateMessage,
+		hooks:             m.hooks,
+		channels:          channelInits(m.controlLabel, m.labels, config.Channels),
+		maxSessions:       config.MaxSessions,
+		binaryFraming:     config.BinaryFraming,
+		metricLabel:       m.poolLabels.value(name),
+		queue:             newWaitQueue(m.queueSize),
+	}
+	if m.historySize > 0 {
+		p.history = newHistory(m.historySize)
+	}
+	if len(config.AllowedLabels) > 0 {
+		p.allowedLabels = map[string]bool{m.controlLabel: true, m.directLabel: true}
+		for label := range p.channels {
+			p.allowedLabels[label] = true
+		}
+		for _, label := range config.AllowedLabels {
+			p.allowedLabels[label] = true
+		}
+	}
+	return p
+}
+
+// maxChannelOverrides limits the number of channel overrides of a pool.
+const maxChannelOverrides = 16
+
+// validateChannels checks the channel overrides of a PoolConfig. They come
+// from clients creating pools, so they're restricted to the channels the
+// server creates anyway and can't claim stream ids.
+func (m *Manager) validateChannels(overrides map[string]webrtc.DataChannelInit) error {
+	if len(overrides) > maxChannelOverrides {
+		return fmt.Errorf("%w: more than %d channels", ErrInvalidPoolConfig, maxChannelOverrides)
+	}
+	for label, init := range overrides {
+		if _, ok := m.labels[label]; !ok && label != m.controlLabel {
+			return fmt.Errorf("%w: unknown channel label %q", ErrInvalidPoolConfig, label)
+		}
+		if init.Negotiated != nil || init.ID != nil {
+			return fmt.Errorf("%w: channel %q must not set negotiated or id", ErrInvalidPoolConfig, label)
+		}
+	}
+	return nil
+}
+
+// channelInits returns the explicit settings of the datachannels the server
+// creates: the control channel, one for each label and the overrides.
+func channelInits(controlLabel string, labels map[string]LabelConfig, overrides map[string]webrtc.DataChannelInit) map[string]webrtc.DataChannelInit {
+	reliable := true
+	inits := map[string]webrtc.DataChannelInit{
+		controlLabel: {Ordered: &reliable},
+	}
+	for label, lc := range labels {
+		ordered := lc.Ordered
+		inits[label] = webrtc.DataChannelInit{
+			Ordered:        &ordered,
+			MaxRetransmits: lc.MaxRetransmits,
+		}
+	}
+	for label, init := range overrides {
+		if init.Ordered == nil {
+			ordered := true
+			init.Ordered = &ordered
+		}
+		inits[label] = init
 	}
-	(*m.pools)[name] = p
+	return inits
+}
+
+// addPool adds p to the pools of the manager. The caller must hold m.mu.
+func (m *Manager) addPool(p *Pool) {
+	(*m.pools)[p.name] = p
 	poolGauge.Set(float64(len(*m.pools)))
-	return p, nil
+	poolsCreatedCounter.Inc()
+}
+
+// ClosePool removes the pool with the given name, deletes its metric series
+// and closes all its sessions.
+func (m *Manager) ClosePool(name string) error {
+	m.mu.Lock()
+	p, ok := (*m.pools)[name]
+	if !ok {
+		m.mu.Unlock()
+		return fmt.Errorf("Couldn't find pool with name %s", name)
+	}
+	delete(*m.pools, name)
+	poolGauge.Set(float64(len(*m.pools)))
+	poolsDeletedCounter.Inc()
+	m.mu.Unlock()
+	m.removePool(p)
+	return p.closeSessions("pool_closed")
+}
+
+// ErrDraining is returned when creating pools or sessions while the manager
+// is draining.
+var ErrDraining = errors.New("Draining, not accepting new pools or sessions")
+
+// ErrPoolFull is returned when joining a pool which reached its maximum
+// number of sessions.
+var ErrPoolFull = errors.New("Pool is full")
+
+// ErrPoolExists is returned when creating a pool with the name of an existing
+// one.
+var ErrPoolExists = errors.New("Pool already exists")
+
+// ErrTooManyPools is returned when creating a pool while the manager has the
+// maximum number of pools already.
+var ErrTooManyPools = errors.New("Maximum number of pools reached")
+
+// ErrInvalidPoolConfig is returned when creating a pool with an invalid
+// PoolConfig.
+var ErrInvalidPoolConfig = errors.New("Invalid pool config")
+
+// ErrInvalidPoolName is returned when creating a pool with a reserved name.
+var ErrInvalidPoolName = errors.New("Invalid pool name")
+
+// Drain stops the manager from accepting new pools and sessions. Existing
+// sessions keep working.
+func (m *Manager) Drain() {
+	if atomic.CompareAndSwapInt32(&m.draining, 0, 1) {
+		level.Info(m.logger).Log("msg", "Draining")
+	}
+}
+
+// Draining returns whether the manager is draining.
+func (m *Manager) Draining() bool {
+	return atomic.LoadInt32(&m.draining) == 1
+}
+
+// SessionCount returns the number of sessions in all local pools.
+func (m *Manager) SessionCount() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n := 0
+	for _, p := range *m.pools {
+		n += p.SessionCount()
+	}
+	return n
+}
+
+// removePool deregisters the removed pool p, deletes its metric series and
+// stops relaying broadcasts to it. It's used by ClosePool, and so by the idle
+// pool reaper, and Shutdown.
+func (m *Manager) removePool(p *Pool) {
+	atomic.StoreInt32(&p.removed, 1)
+	m.poolLabels.release(p.name)
+	if p.unsubscribe != nil {
+		p.unsubscribe()
+	}
+	if p.mirror { // Registered by the hosting node
+		return
+	}
+	if err := m.registry.Deregister(p.name); err != nil {
+		level.Warn(m.logger).Log("msg", "Couldn't deregister pool", "pool", p.name, "error", err)
+	}
+}
+
+// Shutdown cancels in-flight broadcasts and closes all pools and their
+// sessions. If ctx expires before all sessions are closed, Shutdown returns
+// early with the context's error.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.cancel()
+	return m.closePools(ctx, "shutdown")
+}
+
+// Flush closes all pools and their sessions like Shutdown, but the manager
+// keeps accepting new ones afterwards.
+func (m *Manager) Flush(ctx context.Context) error {
+	level.Info(m.logger).Log("msg", "Flushing all pools")
+	return m.closePools(ctx, "flushed")
+}
+
+// closePools closes all pools and their sessions, using reason as close
+// reason of the sessions. If ctx expires before all sessions are closed,
+// closePools returns early with the context's error.
+func (m *Manager) closePools(ctx context.Context, reason string) error {
+	m.mu.Lock()
+	pools := *m.pools
+	m.pools = &map[string]*Pool{}
+	poolGauge.Set(0)
+	poolsDeletedCounter.Add(float64(len(pools)))
+	m.mu.Unlock()
+	for _, p := range pools {
+		m.removePool(p)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, p := range pools {
+			if err := p.closeSessions(reason); err != nil {
+				level.Warn(m.logger).Log("msg", "Couldn't close all sessions", "pool", p.name, "error", err)
+			}
+		}
+	}()
+	select {
+	case <-done:
+		sessionGauge.Set(0)
+		return nil
+	case <-ctx.Done():
+		n := 0
+		for _, p := range pools {
+			n += p.SessionCount()
+		}
+		level.Warn(m.logger).Log("msg", "Closing pools didn't finish in time", "sessions", n, "reason", reason)
+		return ctx.Err()
+	}
+}
+
+// reapPools periodically closes pools that have been empty for longer than
+// the pool TTL.
+func (m *Manager) reapPools() {
+	interval := m.poolTTL / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		m.mu.RLock()
+		var names []string
+		for name, p := range *m.pools {
+			if p.idleFor() > m.poolTTL {
+				names = append(names, name)
+			}
+		}
+		m.mu.RUnlock()
+		for _, name := range names {
+			level.Info(m.logger).Log("msg", "Closing idle pool", "pool", name)
+			if err := m.ClosePool(name); err != nil {
+				level.Warn(m.logger).Log("msg", "Couldn't close idle pool", "pool", name, "error", err)
+			}
+		}
+	}
 }
 
 // Pool manages sessions
 type Pool struct {
-	logger   log.Logger
-	config   webrtc.Configuration
-	sessions *map[string]*Session
+	relayed uint64 // Accessed atomically, first for 64-bit alignment
+	removed int32  // Accessed atomically, 1 once removed from the manager
+
+	name              string
+	logger            log.Logger
+	config            webrtc.Configuration
+	newPeerConnection PeerConnectionFactory
+	sendQueueSize     int
+	maxBufferedAmount uint64
+	maxSendFailures   int
+	logSampler        *sampler
+	controlLabel      string
+	history           *history // nil if disabled
+	maxMessageSize    int
+	maxOversized      int
+	directLabel       string
+	labels            map[string]LabelConfig
+	channels          map[string]webrtc.DataChannelInit // created by the server, by label
+	maxSessions       int
+	binaryFraming     bool
+	metricLabel       string     // Pool label value of metrics
+	queue             *waitQueue // clients waiting for a slot if the pool is full
+	statsInterval     time.Duration
+	gatheringTimeout  time.Duration
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+	compress          bool
+	topology          string
+	answerOptions     *webrtc.AnswerOptions
+	echo              bool
+	allowedLabels     map[string]bool // nil if all labels are allowed
+	created           time.Time
+	bus               MessageBus // nil if disabled
+	nodeID            string
+	mirror            bool   // Hosted by another node
+	unsubscribe       func() // nil if not subscribed to the bus
+	draining          func() bool
+	ctx               context.Context // cancelled on shutdown
+	validateMessage   MessageValidator
+	hooks             SessionHooks
+
+	mu         sync.RWMutex // protects sessions, reserved, emptySince and host
+	sessions   *map[string]*Session
+	reserved   int // slots of sessions being set up, counted towards maxSessions
+	emptySince time.Time
+	host       string // id of the host session if the topology is star
+}
+
+// idleFor returns for how long the pool has been without sessions.
+func (p *Pool) idleFor() time.Duration {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(*p.sessions) > 0 {
+		return 0
+	}
+	return time.Since(p.emptySince)
 }
 
-func (r *Pool) NewSession(sd []byte, id string) (webrtc.SessionDescription, error) {
-	session, err := NewSession(r, id)
+// closeSessions closes all sessions of the pool.
+func (p *Pool) closeSessions(reason string) error {
+	p.mu.RLock()
+	sessions := make([]*Session, 0, len(*p.sessions))
+	for _, s := range *p.sessions {
+		sessions = append(sessions, s)
+	}
+	p.mu.RUnlock()
+	var lastErr error
+	for _, s := range sessions {
+		if err := p.closeSession(s, reason); err != nil {
+			level.Warn(p.logger).Log("msg", "Couldn't close session", "error", err, "session", s.ID)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// NewSession creates a session with the given id and connects it to the
+// offer sd. An existing session with the same id, e.g. from a client
+// rejoining after a network drop, gets replaced and closed if config has its
+// secret. Otherwise an error wrapping ErrInvalidSecret is returned. If
+// connecting fails or ctx gets cancelled, the session gets closed again.
+func (r *Pool) NewSession(ctx context.Context, sd []byte, id string, config SessionConfig) (webrtc.SessionDescription, error) {
+	if r.draining() {
+		return webrtc.SessionDescription{}, ErrDraining
+	}
+	// Reserve a slot before setting up the session, so full pools don't
+	// create peer connections only to close them again.
+	r.mu.Lock()
+	n := len(*r.sessions) + r.reserved
+	if old, ok := (*r.sessions)[id]; ok { // Replacing it doesn't take a slot
+		if !old.authorized(config.Secret) {
+			r.mu.Unlock()
+			return webrtc.SessionDescription{}, fmt.Errorf("Couldn't replace session %s: %w", id, ErrInvalidSecret)
+		}
+		n--
+	}
+	if r.maxSessions > 0 && n >= r.maxSessions {
+		r.mu.Unlock()
+		return webrtc.SessionDescription{}, ErrPoolFull
+	}
+	r.reserved++
+	r.mu.Unlock()
+
+	session, err := NewSession(r, id, config)
+	r.mu.Lock()
+	r.reserved--
+	var old *Session
+	if err == nil {
+		old = (*r.sessions)[id]
+		if old != nil && !old.authorized(config.Secret) {
+			// Another join created the session while this one got set up.
+			err = fmt.Errorf("Couldn't replace session %s: %w", id, ErrInvalidSecret)
+			old = nil
+		} else {
+			(*r.sessions)[id] = session
+			sessionGauge.Set(float64(len(*r.sessions)))
+		}
+	}
+	r.mu.Unlock()
+	if errors.Is(err, ErrInvalidSecret) {
+		if cerr := session.close(); cerr != nil {
+			level.Warn(r.logger).Log("msg", "Couldn't close session", "error", cerr, "session", id)
+		}
+	}
 	if err != nil {
+		if r.maxSessions > 0 {
+			r.queue.notify()
+		}
 		return webrtc.SessionDescription{}, err
 	}
-	(*r.sessions)[id] = session
-	sessionGauge.Set(float64(len(*r.sessions)))
-	return session.Connect(sd)
+	if old != nil {
+		level.Info(r.logger).Log("msg", "Replaced existing session", "session", id)
+		r.sessionRemoved(old, "replaced")
+		if err := old.close(); err != nil {
+			level.Warn(r.logger).Log("msg", "Couldn't close replaced session", "error", err, "session", id)
+		}
+	}
+
+	answer, err := session.Connect(ctx, sd)
+	if err != nil {
+		if cerr := r.closeSession(session, "connect_failed"); cerr != nil {
+			level.Warn(r.logger).Log("msg", "Couldn't close session", "error", cerr, "session", id)
+		}
+		return webrtc.SessionDescription{}, err
+	}
+	return answer, nil
 }
 
-func (p *Pool) CloseSession(id string) error {
+// openSessionIDs returns the ids of all open sessions except the one with id
+// cid and the metadata of those which have any.
+func (p *Pool) openSessionIDs(cid string) ([]string, map[string]string) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	ids := []string{}
+	metadata := map[string]string{}
+	for id, s := range *p.sessions {
+		if id != cid && s.isOpen() {
+			ids = append(ids, id)
+			if s.config.Metadata != "" {
+				metadata[id] = s.config.Metadata
+			}
+		}
+	}
+	return ids, metadata
+}
+
+// SendTo sends data on label to the session with id toID only. If the
+// session's send queue is full, the message is dropped and an error wrapping
+// ErrQueueFull returned.
+func (p *Pool) SendTo(fromID, toID, label string, data []byte) error {
+	p.mu.RLock()
+	s, ok := (*p.sessions)[toID]
+	p.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("Couldn't find session with id %s", toID)
+	}
+	if !s.isOpen() {
+		return fmt.Errorf("Session with id %s isn't open", toID)
+	}
+	level.Debug(p.logger).Log("msg", "Sending direct message", "from", fromID, "to", toID, "label", label)
+	if err := s.enqueue(outMessage{label: label, data: data}); err != nil {
+		return fmt.Errorf("Couldn't send to session %s: %w", toID, err)
+	}
+	return nil
+}
+
+// ErrSessionNotFound is returned when a session doesn't exist in a pool.
+var ErrSessionNotFound = errors.New("Session not found")
+
+// ErrInvalidSecret is returned when restarting, renegotiating or replacing a
+// session with a secret other than the session's.
+var ErrInvalidSecret = errors.New("Invalid session secret")
+
+// authorized returns whether secret is the session's secret.
+func (s *Session) authorized(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(s.config.Secret), []byte(secret)) == 1
+}
+
+// RestartSession answers the ICE restart offer sd for the existing session
+// with the given id and secret.
+func (p *Pool) RestartSession(ctx context.Context, id, secret string, sd []byte) (webrtc.SessionDescription, error) {
+	level.Info(p.logger).Log("msg", "Restarting ICE", "session", id)
+	return p.RenegotiateSession(ctx, id, secret, sd)
+}
+
+// RenegotiateSession answers a new offer sd for the existing session with the
+// given id and secret, e.g. after the client added a datachannel. New
+// datachannels get registered by the session's OnDataChannel handler once
+// they're open.
+func (p *Pool) RenegotiateSession(ctx context.Context, id, secret string, sd []byte) (webrtc.SessionDescription, error) {
+	p.mu.RLock()
+	s, ok := (*p.sessions)[id]
+	p.mu.RUnlock()
+	if !ok {
+		return webrtc.SessionDescription{}, fmt.Errorf("Couldn't renegotiate session %s: %w", id, ErrSessionNotFound)
+	}
+	if !s.authorized(secret) {
+		return webrtc.SessionDescription{}, fmt.Errorf("Couldn't renegotiate session %s: %w", id, ErrInvalidSecret)
+	}
+	return s.Connect(ctx, sd)
+}
+
+// Sessions returns information about the sessions in the pool.
+func (p *Pool) Sessions() []SessionInfo {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	infos := make([]SessionInfo, 0, len(*p.sessions))
+	for _, s := range *p.sessions {
+		infos = append(infos, s.Info())
+	}
+	return infos
+}
+
+// PoolInfo describes a pool.
+type PoolInfo struct {
+	Name            string    `json:"name"`
+	Sessions        int       `json:"sessions"`
+	OpenSessions    int       `json:"openSessions"`
+	MaxSessions     int       `json:"maxSessions"`
+	Created         time.Time `json:"created"`
+	Compress        bool      `json:"compress"`
+	Topology        string    `json:"topology"`
+	Echo            bool      `json:"echo"`
+	Host            string    `json:"host,omitempty"`
+	RelayOnly       bool      `json:"relayOnly"`
+	MessagesRelayed uint64    `json:"messagesRelayed"`
+}
+
+// Info returns information about the pool.
+func (p *Pool) Info() PoolInfo {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	info := PoolInfo{
+		Name:            p.name,
+		Sessions:        len(*p.sessions),
+		MaxSessions:     p.maxSessions,
+		Created:         p.created,
+		Compress:        p.compress,
+		Topology:        p.topology,
+		Echo:            p.echo,
+		Host:            p.host,
+		RelayOnly:       p.config.ICETransportPolicy == webrtc.ICETransportPolicyRelay,
+		MessagesRelayed: atomic.LoadUint64(&p.relayed),
+	}
+	for _, s := range *p.sessions {
+		if s.isOpen() {
+			info.OpenSessions++
+		}
+	}
+	return info
+}
+
+// SessionCount returns the number of sessions in the pool.
+func (p *Pool) SessionCount() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(*p.sessions)
+}
+
+// CloseSession closes the session with the given id. The reason is logged and
+// used as label of the closed sessions metric.
+func (p *Pool) CloseSession(id, reason string) error {
+	p.mu.RLock()
 	session, ok := (*p.sessions)[id]
+	p.mu.RUnlock()
 	if !ok {
 		return fmt.Errorf("Couldn't find session with id %s", id)
 	}
-	if err := session.pc.Close(); err != nil {
-		return err
+	return p.closeSession(session, reason)
+}
+
+// KickSession notifies the other sessions that the session with the given id
+// got kicked and closes it.
+func (p *Pool) KickSession(id string) error {
+	p.mu.RLock()
+	s, ok := (*p.sessions)[id]
+	p.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("Couldn't kick session %s: %w", id, ErrSessionNotFound)
 	}
-	delete(*p.sessions, id)
-	sessionGauge.Set(float64(len(*p.sessions)))
-	return nil
+	level.Info(s.logger).Log("msg", "Kicking session")
+	p.broadcastEvent("kick", s)
+	return p.closeSession(s, "kicked")
+}
+
+// CloseIdle closes all sessions which haven't sent a message, besides pongs,
+// within d and returns how many got closed.
+func (p *Pool) CloseIdle(d time.Duration) int {
+	cutoff := time.Now().Add(-d).UnixNano()
+	p.mu.RLock()
+	var idle []*Session
+	for _, s := range *p.sessions {
+		if atomic.LoadInt64(&s.lastMessage) < cutoff {
+			idle = append(idle, s)
+		}
+	}
+	p.mu.RUnlock()
+	for _, s := range idle {
+		level.Info(s.logger).Log("msg", "Closing idle session", "idle", d)
+		if err := p.closeSession(s, "idle"); err != nil {
+			level.Warn(s.logger).Log("msg", "Couldn't close session", "error", err)
+		}
+	}
+	return len(idle)
+}
+
+// closeSession removes s from the pool, unless it got replaced by a session
+// with the same id already, and closes its PeerConnection. If s got removed,
+// reason is logged and counted.
+func (p *Pool) closeSession(s *Session, reason string) error {
+	p.mu.Lock()
+	cur, removed := (*p.sessions)[s.ID]
+	removed = removed && cur == s
+	if removed {
+		delete(*p.sessions, s.ID)
+		sessionGauge.Set(float64(len(*p.sessions)))
+		if len(*p.sessions) == 0 {
+			p.emptySince = time.Now()
+		}
+	}
+	var host string
+	promoted := removed && p.topology == TopologyStar && p.host == s.ID
+	if promoted {
+		host = p.promoteHost()
+	}
+	p.mu.Unlock()
+	if removed {
+		p.sessionRemoved(s, reason)
+	}
+	if promoted && host != "" {
+		p.announceHost(host)
+	}
+	if removed && p.maxSessions > 0 {
+		p.queue.notify()
+	}
+	return s.close()
+}
+
+// sessionRemoved logs and counts that s got removed from the pool for reason
+// and tells the other sessions it left.
+func (p *Pool) sessionRemoved(s *Session, reason string) {
+	sessionDuration.Observe(time.Since(s.created).Seconds())
+	sessionsClosedCounter.WithLabelValues(reason).Inc()
+	level.Info(s.logger).Log("msg", "Session closed", "reason", reason)
+	if s.isOpen() {
+		p.broadcastEvent("leave", s)
+	}
+}
+
+// controlEvent is sent on the control label to notify sessions about changes
+// in the pool.
+type controlEvent struct {
+	Event    string            `json:"event"`
+	ID       string            `json:"id"`
+	Metadata string            `json:"metadata,omitempty"`
+	IDs      []string          `json:"ids,omitempty"`
+	Host     string            `json:"host,omitempty"`
+	Members  map[string]string `json:"members,omitempty"` // Metadata by session id
 }
 
-func (p *Pool) Broadcast(cid, label string, data []byte) {
+// broadcastEvent sends a control event about session s to all other
+// sessions.
+func (p *Pool) broadcastEvent(event string, s *Session) {
+	data, err := json.Marshal(controlEvent{Event: event, ID: s.ID, Metadata: s.config.Metadata})
+	if err != nil {
+		level.Error(p.logger).Log("msg", "Couldn't encode control event", "error", err)
+		return
+	}
+	p.BroadcastLabels(p.ctx, s.ID, []string{p.controlLabel}, data)
+}
+
+// BroadcastLabels sends server originated data on each of labels to all open
+// sessions except the one with id cid. Sessions without a channel for a label
+// don't receive the data on it.
+func (p *Pool) BroadcastLabels(ctx context.Context, cid string, labels []string, data []byte) {
+	for _, label := range labels {
+		p.Broadcast(ctx, cid, label, data)
+	}
+}
+
+// Broadcast sends data to all open sessions except the one with id cid. If a
+// message bus is configured, it's relayed to the sessions on other nodes too.
+// Sends not started yet when ctx gets cancelled are skipped.
+func (p *Pool) Broadcast(ctx context.Context, cid, label string, data []byte) {
+	if p.bus != nil {
+		p.publish(cid, label, data)
+	}
+	p.broadcast(ctx, cid, label, data)
+}
+
+// broadcast queues data for sending to all local open sessions except the one
+// with id cid. Each session sends its queued messages on its own, so a single
+// slow session doesn't delay delivery to the others.
+func (p *Pool) broadcast(ctx context.Context, cid, label string, data []byte) {
+	defer recoverPanic(p.logger)
+	if ctx.Err() != nil {
+		return
+	}
+	// Only broadcasts of a sampled trace, like the ones of the broadcast
+	// endpoint, get a span. Tracing every message of the sessions would
+	// flood the collector.
+	var span trace.Span = noop.Span{}
+	if trace.SpanContextFromContext(ctx).IsSampled() {
+		_, span = otel.Tracer(instrumentationName).Start(ctx, "broadcast")
+		defer span.End()
+		span.SetAttributes(attribute.String("pool", p.name), attribute.String("label", label), attribute.Int("size", len(data)))
+	}
+	p.mu.RLock()
+	sessions := make([]*Session, 0, len(*p.sessions))
+	compress := false
 	for id, s := range *p.sessions {
-		if !s.open {
+		if id == cid { // No need to broadcast to ourselves
 			continue
 		}
-		if id == cid { // No need to broadcast to ourselves
+		if !s.isOpen() {
 			continue
 		}
-		if rand.Intn(100) < 1 {
-			level.Debug(p.logger).Log("msg", "<", "id", id, "data", string(data))
+		sessions = append(sessions, s)
+		compress = compress || s.compresses(label)
+	}
+	p.mu.RUnlock()
+	broadcastFanout.Observe(float64(len(sessions)))
+	span.SetAttributes(attribute.Int("fanout", len(sessions)))
+
+	var seq uint64
+	if p.history != nil && label != p.controlLabel {
+		seq = p.history.add(label, data)
+	}
+
+	// Compress once for all sessions that negotiated compression. If that
+	// fails, they don't get the message, as they couldn't decode it raw.
+	var compressed []byte
+	if compress {
+		var err error
+		if compressed, err = deflate(data); err != nil {
+			level.Error(p.logger).Log("msg", "Couldn't compress message", "error", err)
 		}
-		messageSentCounter.Inc()
-		if err := s.dc[label].Send(data); err != nil {
-			level.Warn(p.logger).Log("msg", "Couldn't send data", "error", err, "id", id)
+	}
+
+	lc, ok := p.labels[label]
+	reliable := !ok || lc.Reliable()
+	for _, s := range sessions {
+		if ctx.Err() != nil {
+			level.Debug(p.logger).Log("msg", "Broadcast cancelled", "error", ctx.Err(), "label", label)
+			return
 		}
-		// FIXME: Consider binary
-		/*
-			if err := s.dc.Send(datachannel.PayloadBinary{Data: data}); err != nil {
-				level.Warn(p.logger).Log("msg", "Couldn't send data", "error", err, "id", id)
-			}*/
+		m := outMessage{label: label, seq: seq, data: data, reliable: reliable}
+		if s.compresses(label) {
+			if compressed == nil {
+				messageDroppedCounter.WithLabelValues("compression_failed").Inc()
+				continue
+			}
+			m.data = compressed
+			m.saved = len(data) - len(compressed)
+		}
+		s.enqueue(m) // Counts dropped messages
 	}
 }
 
+// SessionConfig holds the settings of a session provided when joining.
+type SessionConfig struct {
+	// Spectator sessions receive broadcasts but the messages they send get
+	// dropped.
+	Spectator bool
+
+	// ClientIP is the IP of the client, after resolving proxies.
+	ClientIP string
+
+	// RemoteAddr is the address the join request came from, which is a
+	// proxy's if the client is behind one.
+	RemoteAddr string
+
+	// Metadata is provided by the client, e.g. a display name, and shared
+	// with the other sessions in control events.
+	Metadata string
+
+	// Compression enables receiving compressed broadcast messages if the pool
+	// compresses them.
+	Compression bool
+
+	// TraceID is the id of the trace the join request is part of. If set,
+	// it's added to the session's logs.
+	TraceID string
+
+	// ClientCN is the common name of the verified TLS client certificate, if
+	// any. If set, it's added to the session's logs.
+	ClientCN string
+
+	// Secret authorizes restarting, renegotiating and replacing the session.
+	// Replacing an existing session requires the same secret.
+	Secret string
+}
+
 // Session is a session with a client, can have multiple datachannels
 type Session struct {
+	lastMessage int64 // Accessed atomically, unix nanoseconds, first for 64-bit alignment
+
 	logger log.Logger
 	*Pool
-	ID   string
-	open bool
-	pc   *webrtc.PeerConnection
-	dc   map[string]*webrtc.DataChannel
+	ID      string
+	config  SessionConfig
+	pc      PeerConnection
+	created time.Time
+
+	closeOnce sync.Once
+	closed    chan struct{} // closed when the session gets closed
+	outbox    chan outMessage
+	replayMu  sync.RWMutex // held while replaying history, sends wait for it
+
+	mu           sync.RWMutex // protects open, dc, replayed, sendFailures, oversized, stats, pingSent, lastPong, coalesced and lastActivity
+	open         bool
+	dc           map[string]DataChannel
+	replayed     map[string]uint64 // sequence number of the last replayed message per label
+	sendFailures int
+	oversized    int
+	stats        *connStats // nil until collected
+	pingSent     time.Time
+	lastPong     time.Time
+	coalesced    map[string][]byte    // latest message per label not broadcast yet
+	lastActivity map[string]time.Time // last message received per label, including pongs
 }
 
-func NewSession(pool *Pool, id string) (*Session, error) {
-	pc, err := webrtc.NewPeerConnection(pool.config)
+func NewSession(pool *Pool, id string, config SessionConfig) (*Session, error) {
+	pc, err := pool.newPeerConnection(pool.config)
 	if err != nil {
 		return nil, err
 	}
 
+	logger := log.With(pool.logger, "session", id, "client_ip", config.ClientIP, "remote_addr", config.RemoteAddr)
+	if config.TraceID != "" {
+		logger = log.With(logger, "trace_id", config.TraceID)
+	}
+	if config.ClientCN != "" {
+		logger = log.With(logger, "client_cn", config.ClientCN)
+	}
 	p := &Session{
-		logger: log.With(pool.logger, "session", id),
-		Pool:   pool,
-		ID:     id,
-		pc:     pc,
-		dc:     make(map[string]*webrtc.DataChannel),
+		lastMessage:  time.Now().UnixNano(),
+		logger:       logger,
+		Pool:         pool,
+		ID:           id,
+		config:       config,
+		pc:           pc,
+		created:      time.Now(),
+		dc:           make(map[string]DataChannel),
+		replayed:     make(map[string]uint64),
+		coalesced:    make(map[string][]byte),
+		lastActivity: make(map[string]time.Time),
+		closed:       make(chan struct{}),
+		outbox:       make(chan outMessage, pool.sendQueueSize),
 	}
 	level.Debug(p.logger).Log("msg", "NewSession")
 	pc.OnConnectionStateChange(p.OnConnectionStateChange)
 	pc.OnDataChannel(p.OnDataChannel)
+
+	// The server creates its channels, so their settings don't depend on how
+	// clients set up theirs.
+	for label, init := range pool.channels {
+		init := init
+		dc, err := pc.CreateDataChannel(label, &init)
+		if err != nil {
+			pc.Close()
+			return nil, fmt.Errorf("Couldn't create datachannel %s: %w", label, err)
+		}
+		p.OnDataChannel(dc)
+	}
+
+	if pool.statsInterval > 0 {
+		go p.collectStats(pool.statsInterval)
+	}
+	for label, lc := range pool.labels {
+		if lc.CoalesceInterval > 0 {
+			go p.flushCoalesced(label, lc.CoalesceInterval)
+		}
+	}
+	if pool.heartbeatInterval > 0 {
+		go p.heartbeat(pool.heartbeatInterval, pool.heartbeatTimeout)
+	}
+	go p.sendLoop()
 	return p, nil
 }
 
+// SessionInfo describes a session for operators.
+type SessionInfo struct {
+	Pool       string    `json:"pool"`
+	ID         string    `json:"id"`
+	Open       bool      `json:"open"`
+	Created    time.Time `json:"created"`
+	ClientIP   string    `json:"clientIP"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Metadata   string    `json:"metadata,omitempty"`
+}
+
+// Info returns information about the session.
+func (p *Session) Info() SessionInfo {
+	return SessionInfo{
+		Pool:       p.Pool.name,
+		ID:         p.ID,
+		Open:       p.isOpen(),
+		Created:    p.created,
+		ClientIP:   p.config.ClientIP,
+		RemoteAddr: p.config.RemoteAddr,
+		Metadata:   p.config.Metadata,
+	}
+}
+
+// close stops the session's goroutines and closes its PeerConnection.
+func (p *Session) close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+	return p.pc.Close()
+}
+
+func (p *Session) isOpen() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.open
+}
+
+// recordSend updates the number of consecutive send failures based on err and
+// returns it.
+func (p *Session) recordSend(err error) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		p.sendFailures = 0
+	} else {
+		p.sendFailures++
+	}
+	return p.sendFailures
+}
+
+// send sends data on the session's datachannel with the given label. If the
+// session has no such open channel or the message with sequence number seq got
+// replayed to it already, nothing is sent. If the channel has more than
+// maxBufferedAmount bytes queued already, the message is dropped instead.
+func (p *Session) send(label string, seq uint64, data []byte) error {
+	defer recoverPanic(p.logger)
+	p.replayMu.RLock()
+	defer p.replayMu.RUnlock()
+	p.mu.RLock()
+	dc := p.dc[label]
+	replayed := p.replayed[label]
+	p.mu.RUnlock()
+	if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return nil
+	}
+	if seq != 0 && seq <= replayed {
+		return nil
+	}
+	if p.maxBufferedAmount > 0 && dc.BufferedAmount() > p.maxBufferedAmount {
+		messageDroppedCounter.WithLabelValues("buffer_full").Inc()
+		return nil
+	}
+	if p.logSampler.Sample() {
+		level.Debug(p.logger).Log("msg", "<", "data", string(data))
+	}
+	messageSentCounter.Inc()
+	atomic.AddUint64(&p.Pool.relayed, 1)
+	// FIXME: Consider binary
+	/*
+		if err := dc.Send(datachannel.PayloadBinary{Data: data}); err != nil {
+			return err
+		}*/
+	return dc.Send(data)
+}
+
 func (p *Session) OnConnectionStateChange(connectionState webrtc.PeerConnectionState) {
+	defer recoverPanic(p.logger)
 	level.Info(p.logger).Log("msg", "ICE Connection State has changed", "connectionState", connectionState.String())
 	switch connectionState {
 	case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateClosed:
-		if err := p.Pool.CloseSession(p.ID); err != nil {
+		if err := p.Pool.closeSession(p, "connection_"+connectionState.String()); err != nil {
 			level.Error(p.logger).Log("msg", "Couldn't close session", "error", err)
 		}
 	}
 }
 
-func (p *Session) OnDataChannel(d *webrtc.DataChannel) {
-	p.dc[d.Label()] = d
-	level.Info(p.logger).Log("msg", "New data channel", "label", d.Label, "id", d.ID)
+func (p *Session) OnDataChannel(d DataChannel) {
+	defer recoverPanic(p.logger)
+	level.Info(p.logger).Log("msg", "New data channel", "label", d.Label(), "id", d.ID())
+	if !p.labelAllowed(d.Label()) {
+		level.Info(p.logger).Log("msg", "Closing data channel with unknown label", "label", d.Label())
+		if err := d.Close(); err != nil {
+			level.Warn(p.logger).Log("msg", "Couldn't close data channel", "error", err)
+		}
+		return
+	}
+	if init, ok := p.channels[d.Label()]; ok && *init.Ordered != d.Ordered() {
+		level.Warn(p.logger).Log("msg", "Data channel ordering doesn't match label config", "label", d.Label(), "ordered", d.Ordered())
+	}
+
+	p.hooks.dataChannel(p, d.Label())
 
-	d.OnOpen(p.OnOpen)
+	var opened int32 // Accessed atomically, 1 while counted as open
+	d.OnOpen(func() {
+		if atomic.CompareAndSwapInt32(&opened, 0, 1) {
+			dataChannelGauge.Inc()
+		}
+		p.addChannel(d)
+		p.OnOpen()
+		p.hooks.channelOpen(p, d.Label())
+		if d.Label() == p.controlLabel {
+			p.sendRoster()
+		}
+	})
 
-	d.OnMessage(func(message webrtc.DataChannelMessage) { p.OnMessage(d.Label(), message) })
+	d.OnClose(func() {
+		if atomic.CompareAndSwapInt32(&opened, 1, 0) {
+			dataChannelGauge.Dec()
+		}
+		p.removeChannel(d)
+	})
+	d.OnMessage(func(message webrtc.DataChannelMessage) { p.OnMessage(p.Pool.ctx, d.Label(), message) })
 }
 
-func (p *Session) OnMessage(label string, message webrtc.DataChannelMessage) {
+// removeChannel stops using the closed datachannel d. Once the session has no
+// channels left, it gets closed.
+func (p *Session) removeChannel(d DataChannel) {
+	defer recoverPanic(p.logger)
+	select {
+	case <-p.closed: // Channels get closed along with the session
+		return
+	default:
+	}
+	label := d.Label()
+	level.Info(p.logger).Log("msg", "Data channel closed", "label", label)
+	p.mu.Lock()
+	if p.dc[label] == d {
+		delete(p.dc, label)
+		delete(p.replayed, label)
+	}
+	empty := p.open && len(p.dc) == 0
+	p.mu.Unlock()
+	if empty {
+		level.Info(p.logger).Log("msg", "Closing session without open data channels")
+		if err := p.Pool.closeSession(p, "channels_closed"); err != nil {
+			level.Error(p.logger).Log("msg", "Couldn't close session", "error", err)
+		}
+	}
+}
+
+// addChannel makes the open datachannel d available for broadcasts. If the
+// pool keeps a history, it gets replayed to d first, so d receives all
+// messages in order.
+func (p *Session) addChannel(d DataChannel) {
+	label := d.Label()
+	if p.history == nil || label == p.controlLabel {
+		p.mu.Lock()
+		p.dc[label] = d
+		p.mu.Unlock()
+		return
+	}
+	// Register the channel before further messages get added to the history,
+	// so it receives all of them, but only after the replay.
+	p.replayMu.Lock()
+	defer p.replayMu.Unlock()
+	messages := p.history.replay(label, func(seq uint64) {
+		p.mu.Lock()
+		p.dc[label] = d
+		p.replayed[label] = seq
+		p.mu.Unlock()
+	})
+	for _, data := range messages {
+		if p.compresses(label) {
+			var err error
+			if data, err = deflate(data); err != nil {
+				level.Error(p.logger).Log("msg", "Couldn't compress message", "error", err)
+				messageDroppedCounter.WithLabelValues("compression_failed").Inc()
+				continue
+			}
+		}
+		if err := d.Send(data); err != nil {
+			level.Warn(p.logger).Log("msg", "Couldn't replay history", "error", err, "label", label)
+			break
+		}
+	}
+}
+
+func (p *Session) OnMessage(ctx context.Context, label string, message webrtc.DataChannelMessage) {
+	defer recoverPanic(p.logger)
 	messageReceivedCounter.Inc()
-	p.Pool.Broadcast(p.ID, label, message.Data)
+	messageSize.Observe(float64(len(message.Data)))
+	p.touch(label)
+	if p.heartbeatInterval > 0 && label == p.controlLabel && p.handlePong(message.Data) {
+		return
+	}
+	atomic.StoreInt64(&p.lastMessage, time.Now().UnixNano())
+	if !p.labelAllowed(label) {
+		messageDroppedCounter.WithLabelValues("unknown_label").Inc()
+		return
+	}
+	if p.config.Spectator {
+		messageDroppedCounter.WithLabelValues("spectator").Inc()
+		return
+	}
+	if p.maxMessageSize > 0 && len(message.Data) > p.maxMessageSize {
+		messageOversizedCounter.Inc()
+		p.mu.Lock()
+		p.oversized++
+		oversized := p.oversized
+		p.mu.Unlock()
+		level.Debug(p.logger).Log("msg", "Dropping oversized message", "label", label, "size", len(message.Data))
+		if p.maxOversized > 0 && oversized >= p.maxOversized {
+			level.Info(p.logger).Log("msg", "Closing session after repeated oversized messages", "count", oversized)
+			if err := p.Pool.closeSession(p, "oversized_messages"); err != nil {
+				level.Warn(p.logger).Log("msg", "Couldn't close session", "error", err)
+			}
+		}
+		return
+	}
+	data, err := p.validateMessage(label, message.Data)
+	if err != nil {
+		messageDroppedCounter.WithLabelValues("rejected").Inc()
+		level.Debug(p.logger).Log("msg", "Dropping rejected message", "label", label, "error", err)
+		return
+	}
+	if p.binaryFraming && !message.IsString {
+		p.routeFrame(ctx, label, data)
+		return
+	}
+	if label == p.directLabel {
+		p.sendDirect(label, data)
+		return
+	}
+	if lc := p.labels[label]; lc.CoalesceInterval > 0 {
+		p.coalesce(label, data)
+		return
+	}
+	p.relay(ctx, label, data)
+}
+
+// sendDirect delivers a direct message of the form "<id>\n<payload>" to the
+// session with the given id, replacing the id with the one of this session.
+func (p *Session) sendDirect(label string, data []byte) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		messageDroppedCounter.WithLabelValues("invalid").Inc()
+		level.Debug(p.logger).Log("msg", "Dropping direct message without recipient")
+		return
+	}
+	msg := append([]byte(p.ID+"\n"), data[i+1:]...)
+	if err := p.Pool.SendTo(p.ID, string(data[:i]), label, msg); err != nil {
+		if !errors.Is(err, ErrQueueFull) { // Counted when dropped already
+			messageDroppedCounter.WithLabelValues("no_recipient").Inc()
+		}
+		level.Debug(p.logger).Log("msg", "Couldn't send direct message", "error", err)
+	}
 }
 
 // OnOpen is called when a connection was established and updates clients
 func (p *Session) OnOpen() {
-	level.Debug(p.logger).Log("msg", "Session open")
+	defer recoverPanic(p.logger)
+	p.mu.Lock()
+	wasOpen := p.open
 	p.open = true
+	p.mu.Unlock()
+	if wasOpen {
+		return
+	}
+	level.Debug(p.logger).Log("msg", "Session open")
+	p.Pool.broadcastEvent("join", p)
+	if p.topology == TopologyStar {
+		p.Pool.claimHost(p)
+	}
+}
+
+// sendRoster sends the ids of all other open sessions in the pool to this
+// session only.
+func (p *Session) sendRoster() {
+	ids, metadata := p.Pool.openSessionIDs(p.ID)
+	p.Pool.mu.RLock()
+	host := p.host
+	p.Pool.mu.RUnlock()
+	data, err := json.Marshal(controlEvent{Event: "roster", ID: p.ID, IDs: ids, Members: metadata, Host: host})
+	if err != nil {
+		level.Error(p.logger).Log("msg", "Couldn't encode roster", "error", err)
+		return
+	}
+	if err := p.send(p.controlLabel, 0, data); err != nil {
+		level.Warn(p.logger).Log("msg", "Couldn't send roster", "error", err)
+	}
 }
 
-func (p *Session) Connect(sd []byte) (webrtc.SessionDescription, error) {
-	offer := webrtc.SessionDescription{
-		Type: webrtc.SDPTypeOffer,
-		SDP: string(sd),
+// ErrInvalidOffer is returned for session descriptions that aren't a valid
+// offer.
+var ErrInvalidOffer = errors.New("Invalid offer")
+
+// parseOffer parses sd, either a JSON encoded session description or raw
+// SDP, and checks that it's an offer.
+func parseOffer(sd []byte) (webrtc.SessionDescription, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(sd), []byte("{")) {
+		var desc webrtc.SessionDescription
+		if err := json.Unmarshal(sd, &desc); err != nil {
+			return desc, fmt.Errorf("%w: %s", ErrInvalidOffer, err)
+		}
+		if desc.Type != webrtc.SDPTypeOffer {
+			return desc, fmt.Errorf("%w: expected offer, got %s", ErrInvalidOffer, desc.Type)
+		}
+		sd = []byte(desc.SDP)
+	}
+	if !bytes.HasPrefix(sd, []byte("m=")) && !bytes.Contains(sd, []byte("\nm=")) {
+		return webrtc.SessionDescription{}, fmt.Errorf("%w: no media description", ErrInvalidOffer)
+	}
+	return webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(sd)}, nil
+}
+
+// Connect sets the offer sd as remote description and returns the answer
+// including all ICE candidates gathered until gatheringTimeout elapses. It
+// aborts if ctx gets cancelled. Offers of an already connected session with
+// new ICE credentials restart ICE.
+func (p *Session) Connect(ctx context.Context, sd []byte) (webrtc.SessionDescription, error) {
+	offer, err := parseOffer(sd)
+	if err != nil {
+		return webrtc.SessionDescription{}, err
 	}
 	level.Debug(p.logger).Log("msg", "Connecting..", "sdp", offer.SDP)
-	/*
-	if err := json.Unmarshal(sd, &offer); err != nil {
+	start := time.Now()
+	tracer := otel.Tracer(instrumentationName)
+	_, span := tracer.Start(ctx, "SetRemoteDescription")
+	err = p.pc.SetRemoteDescription(offer)
+	tracing.SetError(span, err)
+	span.End()
+	if err != nil {
+		if errors.Is(err, webrtc.ErrConnectionClosed) { // e.g. replaced by a rejoin
+			return webrtc.SessionDescription{}, fmt.Errorf("Couldn't set remote description: %w", err)
+		}
+		// Pion parses and validates the SDP only here.
+		return webrtc.SessionDescription{}, fmt.Errorf("%w: couldn't set remote description: %s", ErrInvalidOffer, err)
+	}
+	setRemote := time.Since(start)
+	if err := ctx.Err(); err != nil {
 		return webrtc.SessionDescription{}, err
-	}*/
-	if err := p.pc.SetRemoteDescription(offer); err != nil {
-		return webrtc.SessionDescription{}, fmt.Errorf("Couldn't set remote description: %w", err)
 	}
-	return p.pc.CreateAnswer(nil)
+	start = time.Now()
+	_, span = tracer.Start(ctx, "CreateAnswer")
+	answer, err := p.pc.CreateAnswer(p.answerOptions)
+	tracing.SetError(span, err)
+	span.End()
+	if err != nil {
+		return webrtc.SessionDescription{}, fmt.Errorf("Couldn't create answer: %w", err)
+	}
+	createAnswer := time.Since(start)
+
+	gathered := make(chan struct{})
+	var once sync.Once
+	// When renegotiating, the candidates got gathered already and the state
+	// doesn't change anymore.
+	if p.pc.ICEGatheringState() == webrtc.ICEGatheringStateComplete {
+		once.Do(func() { close(gathered) })
+	}
+	p.pc.OnICEGatheringStateChange(func(state webrtc.ICEGathererState) {
+		if state == webrtc.ICEGathererStateComplete {
+			once.Do(func() { close(gathered) })
+		}
+	})
+	if err := p.pc.SetLocalDescription(answer); err != nil {
+		return webrtc.SessionDescription{}, fmt.Errorf("Couldn't set local description: %w", err)
+	}
+	start = time.Now()
+	_, span = tracer.Start(ctx, "ICEGathering")
+	timer := time.NewTimer(p.gatheringTimeout)
+	defer timer.Stop()
+	select {
+	case <-gathered:
+	case <-timer.C:
+		level.Warn(p.logger).Log("msg", "Timeout gathering ICE candidates, answering with candidates gathered so far", "timeout", p.gatheringTimeout)
+		span.SetAttributes(attribute.Bool("timeout", true))
+	case <-ctx.Done():
+		tracing.SetError(span, ctx.Err())
+		span.End()
+		return webrtc.SessionDescription{}, ctx.Err()
+	}
+	span.End()
+	level.Debug(p.logger).Log("msg", "Answer ready", "set_remote_description", setRemote, "create_answer", createAnswer, "ice_gathering", time.Since(start))
+	if ld := p.pc.LocalDescription(); ld != nil {
+		return *ld, nil
+	}
+	return answer, nil
 }
@@ -0,0 +1,640 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pion/webrtc/v3"
+)
+
+// recordedPeerConnection is a PeerConnection that records being closed.
+type recordedPeerConnection struct {
+	PeerConnection
+	closed int32 // Accessed atomically, 1 once closed
+}
+
+func (pc *recordedPeerConnection) Close() error {
+	atomic.StoreInt32(&pc.closed, 1)
+	return pc.PeerConnection.Close()
+}
+
+func (pc *recordedPeerConnection) isClosed() bool {
+	return atomic.LoadInt32(&pc.closed) == 1
+}
+
+// peerConnections is a PeerConnectionFactory recording the peer connections
+// it creates.
+type peerConnections struct {
+	mu  sync.Mutex
+	pcs []*recordedPeerConnection
+}
+
+func (f *peerConnections) new(config webrtc.Configuration) (PeerConnection, error) {
+	pc, err := newPeerConnection(config)
+	if err != nil {
+		return nil, err
+	}
+	rpc := &recordedPeerConnection{PeerConnection: pc}
+	f.mu.Lock()
+	f.pcs = append(f.pcs, rpc)
+	f.mu.Unlock()
+	return rpc, nil
+}
+
+func (f *peerConnections) all() []*recordedPeerConnection {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*recordedPeerConnection(nil), f.pcs...)
+}
+
+// cancellingPeerConnection cancels the setup of its session while the remote
+// description gets set.
+type cancellingPeerConnection struct {
+	*recordedPeerConnection
+	cancel context.CancelFunc
+}
+
+func (pc *cancellingPeerConnection) SetRemoteDescription(sd webrtc.SessionDescription) error {
+	pc.cancel()
+	return pc.recordedPeerConnection.SetRemoteDescription(sd)
+}
+
+// newOffer returns the offer of a client peer connection with a datachannel.
+// The peer connection is closed when the test finishes.
+func newOffer(t *testing.T) []byte {
+	t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("Couldn't create peer connection: %s", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	if _, err := pc.CreateDataChannel("game", nil); err != nil {
+		t.Fatalf("Couldn't create datachannel: %s", err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("Couldn't create offer: %s", err)
+	}
+	return []byte(offer.SDP)
+}
+
+// session returns the session of pool with the given id or nil.
+func session(pool *Pool, id string) *Session {
+	pool.mu.RLock()
+	defer pool.mu.RUnlock()
+	return (*pool.sessions)[id]
+}
+
+// newTestPool returns a pool with the given config of a new manager
+// configured with opts, which doesn't use STUN servers so ICE gathering
+// completes without network access. The test fails if the manager recovers
+// from a panic.
+func newTestPool(t *testing.T, config PoolConfig, opts ...ManagerOption) *Pool {
+	t.Helper()
+	var panics int32 // Accessed atomically
+	logger := log.LoggerFunc(func(keyvals ...interface{}) error {
+		for i := 0; i+1 < len(keyvals); i += 2 {
+			if keyvals[i] == "msg" && keyvals[i+1] == "Recovered from panic" {
+				atomic.AddInt32(&panics, 1)
+			}
+		}
+		return nil
+	})
+	t.Cleanup(func() {
+		if n := atomic.LoadInt32(&panics); n > 0 {
+			t.Errorf("Recovered from %d panics", n)
+		}
+	})
+	m := NewManager(logger, append([]ManagerOption{WithICEServers(nil)}, opts...)...)
+	t.Cleanup(func() { m.Shutdown(context.Background()) })
+	pool, err := m.NewPool("test", config)
+	if err != nil {
+		t.Fatalf("Couldn't create pool: %s", err)
+	}
+	return pool
+}
+
+// newClient creates a client peer connection with a datachannel for each
+// label and returns it along with its offer, ICE gathering already complete.
+func newClient(t *testing.T, labels ...string) (*webrtc.PeerConnection, map[string]*webrtc.DataChannel, []byte) {
+	t.Helper()
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatalf("Couldn't create peer connection: %s", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	channels := make(map[string]*webrtc.DataChannel, len(labels))
+	for _, label := range labels {
+		dc, err := pc.CreateDataChannel(label, nil)
+		if err != nil {
+			t.Fatalf("Couldn't create datachannel %s: %s", label, err)
+		}
+		channels[label] = dc
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatalf("Couldn't create offer: %s", err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatalf("Couldn't set local description: %s", err)
+	}
+	<-gathered
+	return pc, channels, []byte(pc.LocalDescription().SDP)
+}
+
+// connect joins the pool with a client creating a datachannel for each label
+// and waits until the session has all of them and the control channel open.
+// It returns the session and the client's datachannels by label.
+func connect(t *testing.T, pool *Pool, id string, labels ...string) (*Session, map[string]*webrtc.DataChannel) {
+	t.Helper()
+	pc, channels, sd := newClient(t, labels...)
+	answer, err := pool.NewSession(context.Background(), sd, id, SessionConfig{})
+	if err != nil {
+		t.Fatalf("Couldn't join: %s", err)
+	}
+	if err := pc.SetRemoteDescription(answer); err != nil {
+		t.Fatalf("Couldn't set remote description: %s", err)
+	}
+	s := session(pool, id)
+	waitFor(t, func() bool {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		for _, label := range append(labels, pool.controlLabel) {
+			if s.dc[label] == nil {
+				return false
+			}
+		}
+		return true
+	})
+	return s, channels
+}
+
+// waitFor fails the test if f doesn't return true within 10 seconds.
+func waitFor(t *testing.T, f func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewSessionReplacesSession(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		concurrent bool
+	}{
+		{name: "sequential"},
+		{name: "concurrent", concurrent: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pcs := &peerConnections{}
+			pool := newTestPool(t, PoolConfig{}, WithPeerConnectionFactory(pcs.new))
+			offers := make([][]byte, 3) // Join, then rejoin twice
+			for i := range offers {
+				_, _, offers[i] = newClient(t, "game")
+			}
+			join := func(sd []byte) error {
+				_, err := pool.NewSession(context.Background(), sd, "player", SessionConfig{})
+				return err
+			}
+			if err := join(offers[0]); err != nil {
+				t.Fatalf("Couldn't join: %s", err)
+			}
+			if tc.concurrent {
+				// A rejoin replacing the other one before it's connected
+				// fails, so only the sessions are checked.
+				var wg sync.WaitGroup
+				for _, sd := range offers[1:] {
+					wg.Add(1)
+					go func(sd []byte) {
+						defer wg.Done()
+						join(sd)
+					}(sd)
+				}
+				wg.Wait()
+			} else {
+				for _, sd := range offers[1:] {
+					if err := join(sd); err != nil {
+						t.Fatalf("Couldn't rejoin: %s", err)
+					}
+				}
+			}
+
+			if n := pool.SessionCount(); n != 1 {
+				t.Fatalf("Expected 1 session, got %d", n)
+			}
+			pool.mu.RLock()
+			current := (*pool.sessions)["player"].pc
+			pool.mu.RUnlock()
+			created := pcs.all()
+			if len(created) != len(offers) {
+				t.Fatalf("Expected %d peer connections, got %d", len(offers), len(created))
+			}
+			for i, pc := range created {
+				if pc == current {
+					if pc.isClosed() {
+						t.Errorf("Peer connection %d of the current session got closed", i)
+					}
+				} else if !pc.isClosed() {
+					t.Errorf("Peer connection %d of a replaced session wasn't closed", i)
+				}
+			}
+		})
+	}
+}
+
+func TestNewSessionPoolFull(t *testing.T) {
+	pcs := &peerConnections{}
+	pool := newTestPool(t, PoolConfig{MaxSessions: 1}, WithPeerConnectionFactory(pcs.new))
+	_, _, sd := newClient(t, "game")
+	if _, err := pool.NewSession(context.Background(), sd, "first", SessionConfig{}); err != nil {
+		t.Fatalf("Couldn't join: %s", err)
+	}
+	_, _, sd = newClient(t, "game")
+	if _, err := pool.NewSession(context.Background(), sd, "second", SessionConfig{}); !errors.Is(err, ErrPoolFull) {
+		t.Fatalf("Expected ErrPoolFull, got %v", err)
+	}
+	if n := len(pcs.all()); n != 1 {
+		t.Errorf("Expected 1 peer connection, got %d", n)
+	}
+	if info := pool.Info(); info.Sessions != 1 || info.MaxSessions != 1 {
+		t.Errorf("Expected 1 of 1 sessions in pool info, got %d of %d", info.Sessions, info.MaxSessions)
+	}
+	// Rejoining replaces the session, so it doesn't need another slot.
+	_, _, sd = newClient(t, "game")
+	if _, err := pool.NewSession(context.Background(), sd, "first", SessionConfig{}); err != nil {
+		t.Fatalf("Couldn't rejoin: %s", err)
+	}
+}
+
+func TestNewSessionCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pcs := &peerConnections{}
+	factory := func(config webrtc.Configuration) (PeerConnection, error) {
+		pc, err := pcs.new(config)
+		if err != nil {
+			return nil, err
+		}
+		return &cancellingPeerConnection{recordedPeerConnection: pc.(*recordedPeerConnection), cancel: cancel}, nil
+	}
+	pool := newTestPool(t, PoolConfig{}, WithPeerConnectionFactory(factory))
+	if _, err := pool.NewSession(ctx, newOffer(t), "a", SessionConfig{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if n := pool.SessionCount(); n != 0 {
+		t.Errorf("Expected cancelled session to be removed, got %d sessions", n)
+	}
+	if pcs := pcs.all(); len(pcs) != 1 || !pcs[0].isClosed() {
+		t.Error("Expected the peer connection of the cancelled session to be closed")
+	}
+}
+
+func TestClosedChannelRemoved(t *testing.T) {
+	pool := newTestPool(t, PoolConfig{})
+	s, channels := connect(t, pool, "player", "game", "chat")
+	if err := channels["chat"].Close(); err != nil {
+		t.Fatalf("Couldn't close datachannel: %s", err)
+	}
+	waitFor(t, func() bool {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return s.dc["chat"] == nil
+	})
+	s.mu.RLock()
+	n := len(s.dc)
+	s.mu.RUnlock()
+	if n != 2 { // game and the control channel
+		t.Errorf("Expected 2 datachannels, got %d", n)
+	}
+	if n := pool.SessionCount(); n != 1 {
+		t.Errorf("Expected the session to stay in the pool, got %d sessions", n)
+	}
+}
+
+func TestBroadcastMixedLabels(t *testing.T) {
+	pool := newTestPool(t, PoolConfig{}, WithPeerConnectionFactory((&peerConnections{}).new))
+	clients := map[string][]string{
+		"game":     {"game"},
+		"chat":     {"chat"},
+		"gamechat": {"game", "chat"},
+	}
+	received := make(map[string]chan string, len(clients))
+	sessions := make(map[string]*Session, len(clients))
+	for id, labels := range clients {
+		s, channels := connect(t, pool, id, labels...)
+		sessions[id] = s
+		c := make(chan string, 10)
+		received[id] = c
+		for label, dc := range channels {
+			label := label
+			dc.OnMessage(func(msg webrtc.DataChannelMessage) { c <- label + ":" + string(msg.Data) })
+		}
+	}
+
+	pool.Broadcast(context.Background(), "", "game", []byte("move"))
+	pool.Broadcast(context.Background(), "", "chat", []byte("hi"))
+
+	for id, labels := range clients {
+		want := map[string]bool{}
+		for _, label := range labels {
+			if label == "game" {
+				want["game:move"] = true
+			} else {
+				want["chat:hi"] = true
+			}
+		}
+		for len(want) > 0 {
+			select {
+			case msg := <-received[id]:
+				if !want[msg] {
+					t.Fatalf("Session %s received unexpected message %q", id, msg)
+				}
+				delete(want, msg)
+			case <-time.After(10 * time.Second):
+				t.Fatalf("Session %s didn't receive %v", id, want)
+			}
+		}
+		sessions[id].mu.RLock()
+		failures := sessions[id].sendFailures
+		sessions[id].mu.RUnlock()
+		if failures != 0 {
+			t.Errorf("Session %s has %d send failures", id, failures)
+		}
+	}
+	// Messages on labels a session has no channel for are skipped, not
+	// delivered on another channel.
+	time.Sleep(100 * time.Millisecond)
+	for id, c := range received {
+		select {
+		case msg := <-c:
+			t.Errorf("Session %s received unexpected message %q", id, msg)
+		default:
+		}
+	}
+}
+
+// nopBus is a MessageBus counting subscriptions without relaying anything.
+type nopBus struct {
+	subscriptions int32 // Accessed atomically
+}
+
+func (b *nopBus) Publish(BusMessage) error { return nil }
+
+func (b *nopBus) Subscribe(string, func(BusMessage)) (func(), error) {
+	atomic.AddInt32(&b.subscriptions, 1)
+	return func() { atomic.AddInt32(&b.subscriptions, -1) }, nil
+}
+
+func TestMirrorPool(t *testing.T) {
+	registry := newMemoryRegistry()
+	origin := NewManager(log.NewNopLogger(), WithPoolRegistry(registry), WithNodeID("origin"))
+	defer origin.Shutdown(context.Background())
+	if _, err := origin.NewPool("remote", PoolConfig{Topology: TopologyStar, MaxSessions: 2}); err != nil {
+		t.Fatalf("Couldn't create pool: %s", err)
+	}
+
+	bus := &nopBus{}
+	m := NewManager(log.NewNopLogger(), WithPoolRegistry(registry), WithNodeID("mirror"), WithMessageBus(bus), WithMaxPools(1))
+	defer m.Shutdown(context.Background())
+
+	var rerr *RemotePoolError
+	if _, err := m.Pool("remote"); !errors.As(err, &rerr) || rerr.Node != "origin" {
+		t.Fatalf("Expected RemotePoolError for node origin, got %v", err)
+	}
+	if n := atomic.LoadInt32(&bus.subscriptions); n != 0 {
+		t.Fatalf("Expected Pool not to mirror, got %d subscriptions", n)
+	}
+
+	var wg sync.WaitGroup
+	pools := make([]*Pool, 4)
+	for i := range pools {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p, err := m.JoinPool("remote")
+			if err != nil {
+				t.Errorf("Couldn't join pool: %s", err)
+			}
+			pools[i] = p
+		}(i)
+	}
+	wg.Wait()
+	for _, p := range pools[1:] {
+		if p != pools[0] {
+			t.Fatal("Expected concurrent joins to get the same mirror")
+		}
+	}
+	if n := atomic.LoadInt32(&bus.subscriptions); n != 1 {
+		t.Errorf("Expected 1 subscription, got %d", n)
+	}
+	if p := pools[0]; !p.mirror || p.topology != TopologyStar || p.maxSessions != 2 {
+		t.Errorf("Expected mirror with the origin config, got mirror=%t topology=%s maxSessions=%d", p.mirror, p.topology, p.maxSessions)
+	}
+
+	if _, err := m.NewPool("local", PoolConfig{}); err != nil {
+		t.Errorf("Expected mirror not to count towards max pools, got %s", err)
+	}
+
+	m.Drain()
+	if _, err := origin.NewPool("other", PoolConfig{}); err != nil {
+		t.Fatalf("Couldn't create pool: %s", err)
+	}
+	if _, err := m.JoinPool("other"); !errors.Is(err, ErrDraining) {
+		t.Errorf("Expected ErrDraining, got %v", err)
+	}
+}
+
+func TestRelayWithFakePeerConnections(t *testing.T) {
+	pcs := &fakePeerConnections{}
+	pool := newTestPool(t, PoolConfig{}, WithPeerConnectionFactory(pcs.new))
+	channels := map[string]*fakeDataChannel{}
+	for i, id := range []string{"a", "b"} {
+		answer, err := pool.NewSession(context.Background(), fakeOffer, id, SessionConfig{})
+		if err != nil {
+			t.Fatalf("Couldn't join %s: %s", id, err)
+		}
+		if answer.Type != webrtc.SDPTypeAnswer {
+			t.Fatalf("Expected answer, got %s", answer.Type)
+		}
+		channels[id] = pcs.get(i).openChannel("game")
+	}
+
+	channels["a"].receive([]byte("move"))
+	select {
+	case data := <-channels["b"].sent:
+		if string(data) != "move" {
+			t.Errorf("Expected move, got %q", data)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Message of a didn't reach b")
+	}
+	select {
+	case data := <-channels["a"].sent:
+		t.Errorf("Expected a not to receive its own message, got %q", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	channels["b"].Close()
+	waitFor(t, func() bool { return pool.SessionCount() == 1 })
+}
+
+func TestRenegotiateSession(t *testing.T) {
+	pcs := &fakePeerConnections{}
+	pool := newTestPool(t, PoolConfig{}, WithPeerConnectionFactory(pcs.new), WithGatheringTimeout(time.Minute))
+	if _, err := pool.NewSession(context.Background(), fakeOffer, "a", SessionConfig{Secret: "secret"}); err != nil {
+		t.Fatalf("Couldn't join: %s", err)
+	}
+	pcs.get(0).openChannel("game")
+
+	// Gathering completed while joining, so the answer mustn't wait for it.
+	done := make(chan error, 1)
+	go func() {
+		_, err := pool.RenegotiateSession(context.Background(), "a", "secret", fakeOffer)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Couldn't renegotiate: %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Renegotiating waited for ICE gathering")
+	}
+	pcs.get(0).openChannel("chat")
+	waitFor(t, func() bool {
+		s := session(pool, "a")
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return s.dc["game"] != nil && s.dc["chat"] != nil
+	})
+
+	if _, err := pool.RenegotiateSession(context.Background(), "missing", "secret", fakeOffer); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+func TestSessionSecret(t *testing.T) {
+	pcs := &fakePeerConnections{}
+	pool := newTestPool(t, PoolConfig{}, WithPeerConnectionFactory(pcs.new))
+	join := func(secret string) error {
+		_, err := pool.NewSession(context.Background(), fakeOffer, "a", SessionConfig{Secret: secret})
+		return err
+	}
+	if err := join("secret"); err != nil {
+		t.Fatalf("Couldn't join: %s", err)
+	}
+	current := session(pool, "a")
+
+	for _, secret := range []string{"", "wrong"} {
+		if err := join(secret); !errors.Is(err, ErrInvalidSecret) {
+			t.Errorf("Expected rejoining with secret %q to fail with ErrInvalidSecret, got %v", secret, err)
+		}
+		for _, f := range []func(context.Context, string, string, []byte) (webrtc.SessionDescription, error){pool.RenegotiateSession, pool.RestartSession} {
+			if _, err := f(context.Background(), "a", secret, fakeOffer); !errors.Is(err, ErrInvalidSecret) {
+				t.Errorf("Expected renegotiating with secret %q to fail with ErrInvalidSecret, got %v", secret, err)
+			}
+		}
+	}
+	if s := session(pool, "a"); s != current {
+		t.Fatal("Session got replaced without its secret")
+	}
+	pcs.mu.Lock()
+	n := len(pcs.pcs)
+	pcs.mu.Unlock()
+	if n != 1 {
+		t.Errorf("Expected rejected rejoins not to create peer connections, got %d", n)
+	}
+
+	if err := join("secret"); err != nil {
+		t.Fatalf("Couldn't rejoin with secret: %s", err)
+	}
+	if s := session(pool, "a"); s == current {
+		t.Error("Session didn't get replaced when rejoining with its secret")
+	}
+}
+
+func TestNewIDGenerator(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		alphabet string
+		length   int
+		valid    bool
+	}{
+		{name: "URL-safe", alphabet: "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_", length: 11, valid: true},
+		{name: "multi-byte characters", alphabet: "äöü€", length: 32, valid: true},
+		{name: "too little entropy", alphabet: "0123456789", length: 19},
+		{name: "duplicate character", alphabet: "abcabc", length: 64},
+		{name: "single character", alphabet: "a", length: 64},
+		{name: "empty", alphabet: "", length: 64},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gen, err := NewIDGenerator(tc.alphabet, tc.length)
+			if !tc.valid {
+				if err == nil {
+					t.Fatal("Expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Couldn't create id generator: %s", err)
+			}
+			seen := map[string]bool{}
+			for i := 0; i < 100; i++ {
+				id := []rune(gen())
+				if len(id) != tc.length {
+					t.Fatalf("Expected id of length %d, got %q", tc.length, string(id))
+				}
+				for _, r := range id {
+					if !strings.ContainsRune(tc.alphabet, r) {
+						t.Fatalf("Id %q has character %q not in alphabet", string(id), r)
+					}
+				}
+				if seen[string(id)] {
+					t.Fatalf("Duplicate id %q", string(id))
+				}
+				seen[string(id)] = true
+			}
+		})
+	}
+}
+
+func TestWithIDGenerator(t *testing.T) {
+	m := NewManager(log.NewNopLogger(), WithIDGenerator(func() string { return "fixed" }))
+	defer m.Shutdown(context.Background())
+	if id := m.NewID(); id != "fixed" {
+		t.Errorf("Expected id from generator, got %q", id)
+	}
+}
+
+func TestPoolLabels(t *testing.T) {
+	l := newPoolLabels(2)
+	for name, expected := range map[string]string{"a": "a", "other": "other"} {
+		if v := l.value(name); v != expected {
+			t.Errorf("Expected label value %s for pool %s, got %s", expected, name, v)
+		}
+	}
+	if v := l.value("c"); v != poolLabelOther {
+		t.Errorf("Expected pool past the limit to get %s, got %s", poolLabelOther, v)
+	}
+	l.release("a")
+	if v := l.value("c"); v != "c" {
+		t.Errorf("Expected released label value to be reused, got %s", v)
+	}
+
+	m := NewManager(log.NewNopLogger())
+	defer m.Shutdown(context.Background())
+	if _, err := m.NewPool(poolLabelOther, PoolConfig{}); !errors.Is(err, ErrInvalidPoolName) {
+		t.Errorf("Expected ErrInvalidPoolName for pool named %s, got %v", poolLabelOther, err)
+	}
+}
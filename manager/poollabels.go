@@ -0,0 +1,47 @@
+package manager
+
+import "sync"
+
+// poolLabelOther is the pool label value shared by pools past the limit of
+// distinct pool label values. Pools can't have it as name.
+const poolLabelOther = "_other"
+
+// poolLabels limits the number of distinct pool label values of metrics, so
+// ephemeral pool names don't explode their cardinality. Pools get their name
+// as label value while below the limit and share poolLabelOther otherwise.
+type poolLabels struct {
+	mu     sync.Mutex
+	max    int // Zero means unlimited
+	values map[string]bool
+}
+
+func newPoolLabels(max int) *poolLabels {
+	return &poolLabels{max: max, values: make(map[string]bool)}
+}
+
+// value returns the label value for the pool with the given name.
+func (l *poolLabels) value(name string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.values[name] {
+		return name
+	}
+	if l.max > 0 && len(l.values) >= l.max {
+		return poolLabelOther
+	}
+	l.values[name] = true
+	return name
+}
+
+// release deletes the series of the pool with the given name and frees its
+// label value for other pools.
+func (l *poolLabels) release(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.values[name] {
+		return
+	}
+	delete(l.values, name)
+	rttGauge.DeleteLabelValues(name)
+	lossGauge.DeleteLabelValues(name)
+}
@@ -0,0 +1,66 @@
+package manager
+
+import (
+	"container/list"
+	"sync"
+)
+
+// waitQueue is a bounded FIFO of clients waiting for a slot in a full pool.
+// Once it's full, the oldest waiters get dropped.
+type waitQueue struct {
+	mu      sync.Mutex
+	size    int
+	waiters *list.List // of chan bool
+}
+
+func newWaitQueue(size int) *waitQueue {
+	return &waitQueue{size: size, waiters: list.New()}
+}
+
+// add adds a waiter. The returned channel receives true once a slot opens
+// or false if the waiter got dropped. Calling the returned func removes the
+// waiter from the queue.
+func (q *waitQueue) add() (<-chan bool, func()) {
+	c := make(chan bool, 1)
+	q.mu.Lock()
+	e := q.waiters.PushBack(c)
+	for q.waiters.Len() > q.size {
+		q.waiters.Remove(q.waiters.Front()).(chan bool) <- false
+	}
+	q.mu.Unlock()
+	return c, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		for f := q.waiters.Front(); f != nil; f = f.Next() {
+			if f == e {
+				q.waiters.Remove(e)
+				return
+			}
+		}
+	}
+}
+
+// notify tells the oldest waiter that a slot opened.
+func (q *waitQueue) notify() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if f := q.waiters.Front(); f != nil {
+		q.waiters.Remove(f).(chan bool) <- true
+	}
+}
+
+// WaitForSlot queues the caller for a slot in the pool. The returned channel
+// receives true once a slot opens, right away if the pool isn't full, or
+// false if the caller got dropped from the full queue. The returned func must
+// be called once the caller stops waiting.
+func (p *Pool) WaitForSlot() (<-chan bool, func()) {
+	p.mu.RLock()
+	full := p.maxSessions > 0 && len(*p.sessions)+p.reserved >= p.maxSessions
+	p.mu.RUnlock()
+	if !full {
+		c := make(chan bool, 1)
+		c <- true
+		return c, func() {}
+	}
+	return p.queue.add()
+}
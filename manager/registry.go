@@ -0,0 +1,86 @@
+package manager
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// PoolRegistry records which node hosts which pool, so pools can be
+// discovered across multiple server instances. Implementations must be safe
+// for concurrent use.
+type PoolRegistry interface {
+	// Register records the pool name. It fails with ErrPoolExists if the
+	// pool is registered already.
+	Register(name string, record PoolRecord) error
+	// Deregister removes the pool name.
+	Deregister(name string) error
+	// Lookup returns the record of the pool name.
+	Lookup(name string) (record PoolRecord, ok bool, err error)
+	// Pools returns the names of all registered pools.
+	Pools() ([]string, error)
+}
+
+// PoolRecord is what a PoolRegistry stores about a pool.
+type PoolRecord struct {
+	// Node is the id of the node hosting the pool.
+	Node string `json:"node"`
+	// Config is the config the pool was created with, so other nodes
+	// mirror it with the same settings.
+	Config PoolConfig `json:"config"`
+}
+
+// RemotePoolError is returned when a pool is hosted by another node.
+type RemotePoolError struct {
+	Name string
+	Node string
+}
+
+func (e *RemotePoolError) Error() string {
+	return fmt.Sprintf("Pool %s is hosted by node %s", e.Name, e.Node)
+}
+
+// memoryRegistry is the default PoolRegistry for a single instance.
+type memoryRegistry struct {
+	mu    sync.RWMutex
+	pools map[string]PoolRecord
+}
+
+func newMemoryRegistry() *memoryRegistry {
+	return &memoryRegistry{pools: make(map[string]PoolRecord)}
+}
+
+func (r *memoryRegistry) Register(name string, record PoolRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.pools[name]; ok {
+		return fmt.Errorf("Couldn't register pool %s: %w", name, ErrPoolExists)
+	}
+	r.pools[name] = record
+	return nil
+}
+
+func (r *memoryRegistry) Deregister(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.pools, name)
+	return nil
+}
+
+func (r *memoryRegistry) Lookup(name string) (PoolRecord, bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	record, ok := r.pools[name]
+	return record, ok, nil
+}
+
+func (r *memoryRegistry) Pools() ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.pools))
+	for name := range r.pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
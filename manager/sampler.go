@@ -0,0 +1,36 @@
+package manager
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// sampler decides whether an event should be sampled, e.g. logged, based on
+// a rate between 0 (never) and 1 (always).
+type sampler struct {
+	rate float64
+
+	mu   sync.Mutex // protects rand
+	rand *rand.Rand
+}
+
+func newSampler(rate float64) *sampler {
+	return &sampler{
+		rate: rate,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Sample reports whether the current event should be sampled.
+func (s *sampler) Sample() bool {
+	if s.rate <= 0 {
+		return false
+	}
+	if s.rate >= 1 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rand.Float64() < s.rate
+}
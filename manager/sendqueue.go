@@ -0,0 +1,70 @@
+package manager
+
+import (
+	"errors"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// ErrQueueFull is returned when a message couldn't be queued for sending
+// because the session's send queue is full.
+var ErrQueueFull = errors.New("Send queue is full")
+
+// outMessage is a message queued for sending to a session.
+type outMessage struct {
+	label    string
+	seq      uint64
+	data     []byte
+	saved    int  // Bytes saved by compressing data
+	reliable bool // Count failures towards maxSendFailures
+}
+
+// enqueue queues m for sending without blocking. If the session's send queue
+// is full, m is dropped and ErrQueueFull returned.
+func (p *Session) enqueue(m outMessage) error {
+	sendQueueLength.Observe(float64(len(p.outbox)))
+	select {
+	case <-p.closed:
+	case p.outbox <- m:
+	default:
+		messageDroppedCounter.WithLabelValues("queue_full").Inc()
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// sendLoop sends the queued messages until the session gets closed, so a slow
+// session only delays its own messages.
+func (p *Session) sendLoop() {
+	defer recoverPanic(p.logger)
+	for {
+		var m outMessage
+		select {
+		case <-p.closed:
+			return
+		case m = <-p.outbox:
+		}
+		err := p.send(m.label, m.seq, m.data)
+		if err == nil && m.saved > 0 {
+			compressionSavedCounter.Add(float64(m.saved))
+		}
+		if !m.reliable {
+			if err != nil {
+				level.Debug(p.logger).Log("msg", "Couldn't send data", "error", err)
+			}
+			continue
+		}
+		failures := p.recordSend(err)
+		if err == nil {
+			continue
+		}
+		level.Warn(p.logger).Log("msg", "Couldn't send data", "error", err)
+		if p.maxSendFailures > 0 && failures >= p.maxSendFailures {
+			level.Info(p.logger).Log("msg", "Closing session after repeated send failures", "failures", failures)
+			if err := p.Pool.closeSession(p, "send_failures"); err != nil {
+				level.Warn(p.logger).Log("msg", "Couldn't close session", "error", err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package manager
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/pion/webrtc/v3"
+)
+
+// connStats holds the connection quality of a session.
+type connStats struct {
+	rtt  float64 // Round trip time in seconds
+	loss float64 // Ratio of unanswered STUN requests
+}
+
+// nominatedPairStats returns the stats of the nominated ICE candidate pair in
+// report.
+func nominatedPairStats(report webrtc.StatsReport) (webrtc.ICECandidatePairStats, bool) {
+	for _, s := range report {
+		ps, ok := s.(webrtc.ICECandidatePairStats)
+		if ok && ps.Nominated {
+			return ps, true
+		}
+	}
+	return webrtc.ICECandidatePairStats{}, false
+}
+
+// collectStats periodically collects the connection stats of the session
+// until it gets closed.
+func (p *Session) collectStats(interval time.Duration) {
+	defer recoverPanic(p.logger)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+		}
+		ps, ok := nominatedPairStats(p.pc.GetStats())
+		if !ok {
+			continue
+		}
+		cs := connStats{rtt: ps.CurrentRoundTripTime}
+		if ps.RequestsSent > 0 && ps.ResponsesReceived <= ps.RequestsSent {
+			cs.loss = 1 - float64(ps.ResponsesReceived)/float64(ps.RequestsSent)
+		}
+		p.mu.Lock()
+		p.stats = &cs
+		p.mu.Unlock()
+		level.Debug(p.logger).Log("msg", "Collected stats", "rtt", cs.rtt, "loss", cs.loss)
+		p.Pool.updateStats()
+	}
+}
+
+// updateStats sets the pool's connection quality metrics to the average of
+// its sessions. Once the pool got removed, its series are gone and must not
+// be recreated by sessions still closing.
+func (p *Pool) updateStats() {
+	if atomic.LoadInt32(&p.removed) == 1 {
+		return
+	}
+	var (
+		sum connStats
+		n   int
+	)
+	p.mu.RLock()
+	for _, s := range *p.sessions {
+		s.mu.RLock()
+		if s.stats != nil {
+			sum.rtt += s.stats.rtt
+			sum.loss += s.stats.loss
+			n++
+		}
+		s.mu.RUnlock()
+	}
+	p.mu.RUnlock()
+	if n == 0 {
+		return
+	}
+	rttGauge.WithLabelValues(p.metricLabel).Set(sum.rtt / float64(n))
+	lossGauge.WithLabelValues(p.metricLabel).Set(sum.loss / float64(n))
+}
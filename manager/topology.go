@@ -0,0 +1,84 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// Topologies of a pool.
+const (
+	// TopologyMesh broadcasts messages of every session to all others.
+	TopologyMesh = "mesh"
+	// TopologyStar routes messages of all sessions to the host session only
+	// and broadcasts the messages of the host to all others.
+	TopologyStar = "star"
+)
+
+// claimHost makes s the host of a star topology pool if there is none yet.
+func (p *Pool) claimHost(s *Session) {
+	p.mu.Lock()
+	claimed := p.host == ""
+	if claimed {
+		p.host = s.ID
+	}
+	p.mu.Unlock()
+	if claimed {
+		p.announceHost(s.ID)
+	}
+}
+
+// promoteHost makes the longest connected open session the host after the
+// host left. The caller must hold p.mu.
+func (p *Pool) promoteHost() string {
+	var next *Session
+	for _, s := range *p.sessions {
+		if s.isOpen() && (next == nil || s.created.Before(next.created)) {
+			next = s
+		}
+	}
+	p.host = ""
+	if next != nil {
+		p.host = next.ID
+	}
+	return p.host
+}
+
+// announceHost sends a host event with the id of the new host to all sessions,
+// including the host.
+func (p *Pool) announceHost(id string) {
+	level.Info(p.logger).Log("msg", "New host", "session", id)
+	data, err := json.Marshal(controlEvent{Event: "host", ID: id})
+	if err != nil {
+		level.Error(p.logger).Log("msg", "Couldn't encode control event", "error", err)
+		return
+	}
+	p.BroadcastLabels(p.ctx, "", []string{p.controlLabel}, data)
+}
+
+// relay forwards data the session sent on label according to the pool's
+// topology, or back to the session in echo pools.
+func (p *Session) relay(ctx context.Context, label string, data []byte) {
+	if p.echo {
+		if err := p.Pool.SendTo(p.ID, p.ID, label, data); err != nil {
+			level.Debug(p.logger).Log("msg", "Couldn't echo message", "error", err)
+		}
+		return
+	}
+	if p.topology != TopologyStar {
+		p.Pool.Broadcast(ctx, p.ID, label, data)
+		return
+	}
+	p.Pool.mu.RLock()
+	host := p.host
+	p.Pool.mu.RUnlock()
+	if host == p.ID {
+		p.Pool.Broadcast(ctx, p.ID, label, data)
+		return
+	}
+	if err := p.Pool.SendTo(p.ID, host, label, data); err != nil {
+		messageDroppedCounter.WithLabelValues("no_recipient").Inc()
+		level.Debug(p.logger).Log("msg", "Couldn't send message to host", "error", err)
+	}
+}
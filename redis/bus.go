@@ -0,0 +1,76 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/discordianfish/infisk8-server/manager"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// Bus is a manager.MessageBus relaying broadcasts through Redis pub/sub.
+// Messages of a pool are published JSON encoded on the channel named like
+// the pool's key in the Registry. Each subscribed pool uses a connection of
+// its own.
+type Bus struct {
+	client *goredis.Client
+	prefix string
+	logger log.Logger
+}
+
+// NewBus returns a Bus for the Redis server configured by config. The TTL
+// isn't used.
+func NewBus(config Config) *Bus {
+	config.setDefaults()
+	return &Bus{
+		client: newClient(config),
+		prefix: config.Prefix,
+		logger: config.Logger,
+	}
+}
+
+func (b *Bus) Publish(msg manager.BusMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("Couldn't encode message: %w", err)
+	}
+	if err := b.client.Publish(context.Background(), b.prefix+msg.Pool, payload).Err(); err != nil {
+		return fmt.Errorf("Couldn't publish to pool %s: %w", msg.Pool, err)
+	}
+	return nil
+}
+
+// Subscribe returns once Redis confirmed the subscription, so messages
+// published afterwards are delivered to f.
+func (b *Bus) Subscribe(pool string, f func(manager.BusMessage)) (func(), error) {
+	ps := b.client.Subscribe(context.Background())
+	if err := ps.Subscribe(context.Background(), b.prefix+pool); err != nil {
+		ps.Close()
+		return nil, fmt.Errorf("Couldn't subscribe to pool %s: %w", pool, err)
+	}
+	if _, err := ps.Receive(context.Background()); err != nil {
+		ps.Close()
+		return nil, fmt.Errorf("Couldn't subscribe to pool %s: %w", pool, err)
+	}
+	go func() {
+		for m := range ps.Channel() {
+			var msg manager.BusMessage
+			if err := json.Unmarshal([]byte(m.Payload), &msg); err != nil {
+				level.Warn(b.logger).Log("msg", "Couldn't decode message", "pool", pool, "error", err)
+				continue
+			}
+			f(msg)
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { ps.Close() }) }, nil
+}
+
+// Close closes the connections to Redis.
+func (b *Bus) Close() error {
+	return b.client.Close()
+}
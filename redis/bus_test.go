@@ -0,0 +1,54 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/discordianfish/infisk8-server/api"
+	"github.com/discordianfish/infisk8-server/api/apitest"
+	"github.com/discordianfish/infisk8-server/manager"
+	"github.com/go-kit/kit/log"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestBusRelaysBroadcasts(t *testing.T) {
+	server := miniredis.RunT(t)
+	newNode := func(id string) []manager.ManagerOption {
+		registry := NewRegistry(Config{Addr: server.Addr()})
+		bus := NewBus(Config{Addr: server.Addr()})
+		t.Cleanup(func() {
+			registry.Close()
+			bus.Close()
+		})
+		return []manager.ManagerOption{
+			manager.WithNodeID(id),
+			manager.WithPoolRegistry(registry),
+			manager.WithMessageBus(bus),
+			manager.WithICEServers(nil),
+		}
+	}
+
+	a := manager.NewManager(log.NewNopLogger(), newNode("a")...)
+	defer a.Shutdown(context.Background())
+	pool, err := a.NewPool("test", manager.PoolConfig{})
+	if err != nil {
+		t.Fatalf("Couldn't create pool: %s", err)
+	}
+
+	b, _ := apitest.NewServer(t, api.Config{}, newNode("b")...)
+	session := apitest.Join(t, b, "test", 10*time.Second, "game")
+	received := make(chan string, 1)
+	session.Channels["game"].OnMessage(func(msg webrtc.DataChannelMessage) { received <- string(msg.Data) })
+
+	pool.Broadcast(context.Background(), "", "game", []byte("hello"))
+	select {
+	case msg := <-received:
+		if msg != "hello" {
+			t.Errorf("Expected hello, got %q", msg)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Broadcast on node a didn't reach the session on node b")
+	}
+}
@@ -0,0 +1,53 @@
+// Package redis implements a manager.PoolRegistry and a manager.MessageBus
+// backed by Redis.
+package redis
+
+import (
+	"time"
+
+	"github.com/go-kit/kit/log"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// Config configures a Registry.
+type Config struct {
+	// Addr is the host:port of the Redis server.
+	Addr string
+	// Password is sent with AUTH after connecting unless it's empty.
+	Password string
+	// Prefix is prepended to pool names to get their keys. It defaults to
+	// DefaultPrefix.
+	Prefix string
+	// Timeout limits connecting and each command. It defaults to one second.
+	Timeout time.Duration
+	// TTL is how long keys of pools outlive the node which registered them.
+	// The node refreshes them every third of it. It defaults to DefaultTTL.
+	TTL time.Duration
+	// Logger logs failures to refresh keys. It defaults to a nop logger.
+	Logger log.Logger
+}
+
+func (c *Config) setDefaults() {
+	if c.Prefix == "" {
+		c.Prefix = DefaultPrefix
+	}
+	if c.Timeout == 0 {
+		c.Timeout = time.Second
+	}
+	if c.TTL == 0 {
+		c.TTL = DefaultTTL
+	}
+	if c.Logger == nil {
+		c.Logger = log.NewNopLogger()
+	}
+}
+
+func newClient(config Config) *goredis.Client {
+	return goredis.NewClient(&goredis.Options{
+		Addr:         config.Addr,
+		Password:     config.Password,
+		DialTimeout:  config.Timeout,
+		ReadTimeout:  config.Timeout,
+		WriteTimeout: config.Timeout,
+	})
+}
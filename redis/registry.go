@@ -0,0 +1,212 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/discordianfish/infisk8-server/manager"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+const (
+	// DefaultPrefix is the default prefix of the keys pools are stored
+	// under.
+	DefaultPrefix = "infisk8:pool:"
+	// DefaultTTL is the default time keys of pools outlive their node.
+	DefaultTTL = 30 * time.Second
+)
+
+// Registry is a manager.PoolRegistry storing each pool as JSON encoded
+// manager.PoolRecord under the key prefix followed by the pool name, so
+// server instances using the same Redis discover each other's pools. Keys
+// expire after the configured TTL unless the registering node keeps
+// refreshing them, so pools of crashed nodes disappear.
+type Registry struct {
+	client *goredis.Client
+	prefix string
+	ttl    time.Duration
+	logger log.Logger
+
+	mu    sync.Mutex
+	owned map[string]string // Encoded records of the pools registered here by key
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewRegistry returns a Registry for the Redis server configured by config.
+// It connects lazily on first use and refreshes the keys of the pools it
+// registered until it's closed.
+func NewRegistry(config Config) *Registry {
+	config.setDefaults()
+	r := &Registry{
+		client: newClient(config),
+		prefix: config.Prefix,
+		ttl:    config.TTL,
+		logger: config.Logger,
+		owned:  make(map[string]string),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go r.refreshLoop()
+	return r
+}
+
+func (r *Registry) Register(name string, record manager.PoolRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("Couldn't encode pool %s: %w", name, err)
+	}
+	key := r.prefix + name
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ok, err := r.client.SetNX(context.Background(), key, value, r.ttl).Result()
+	if err != nil {
+		return fmt.Errorf("Couldn't register pool %s: %w", name, err)
+	}
+	if !ok {
+		return fmt.Errorf("Couldn't register pool %s: %w", name, manager.ErrPoolExists)
+	}
+	r.owned[key] = string(value)
+	return nil
+}
+
+func (r *Registry) Deregister(name string) error {
+	key := r.prefix + name
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	value, ok := r.owned[key]
+	if !ok {
+		return nil // Registered by another node
+	}
+	delete(r.owned, key)
+	if err := deleteScript.Run(context.Background(), r.client, []string{key}, value).Err(); err != nil {
+		return fmt.Errorf("Couldn't deregister pool %s: %w", name, err)
+	}
+	return nil
+}
+
+func (r *Registry) Lookup(name string) (manager.PoolRecord, bool, error) {
+	var record manager.PoolRecord
+	value, err := r.client.Get(context.Background(), r.prefix+name).Bytes()
+	if errors.Is(err, goredis.Nil) {
+		return record, false, nil
+	}
+	if err != nil {
+		return record, false, fmt.Errorf("Couldn't look up pool %s: %w", name, err)
+	}
+	if err := json.Unmarshal(value, &record); err != nil {
+		return record, false, fmt.Errorf("Couldn't decode pool %s: %w", name, err)
+	}
+	return record, true, nil
+}
+
+// Pools scans the keys with the prefix, so it's safe to use on a Redis
+// shared with other applications.
+func (r *Registry) Pools() ([]string, error) {
+	names := []string{}
+	seen := map[string]bool{} // SCAN may return keys more than once
+	pattern := globEscaper.Replace(r.prefix) + "*"
+	iter := r.client.Scan(context.Background(), 0, pattern, 100).Iterator()
+	for iter.Next(context.Background()) {
+		name := strings.TrimPrefix(iter.Val(), r.prefix)
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("Couldn't list pools: %w", err)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Close stops refreshing, deletes the keys of the pools still registered
+// here and closes the connections to Redis.
+func (r *Registry) Close() error {
+	close(r.stop)
+	<-r.done
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var err error
+	for key, value := range r.owned {
+		if derr := deleteScript.Run(context.Background(), r.client, []string{key}, value).Err(); derr != nil && err == nil {
+			err = fmt.Errorf("Couldn't deregister pools: %w", derr)
+		}
+	}
+	r.owned = make(map[string]string)
+	if cerr := r.client.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (r *Registry) refreshLoop() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.refresh()
+		}
+	}
+}
+
+// refresh extends the TTL of the keys registered here. Keys which expired
+// anyway, for example because Redis was unreachable for longer than the
+// TTL, are set again unless another node registered the pool meanwhile.
+func (r *Registry) refresh() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, value := range r.owned {
+		n, err := refreshScript.Run(context.Background(), r.client, []string{key}, value, r.ttl.Milliseconds()).Int()
+		switch {
+		case err != nil:
+			level.Warn(r.logger).Log("msg", "Couldn't refresh pool", "key", key, "error", err)
+		case n == 0:
+			level.Warn(r.logger).Log("msg", "Pool expired and got registered by another node", "key", key)
+			delete(r.owned, key)
+		case n == 2:
+			level.Warn(r.logger).Log("msg", "Pool expired, registered it again", "key", key)
+		}
+	}
+}
+
+// refreshScript extends the TTL of the key KEYS[1] to ARGV[2] milliseconds
+// if it's still set to ARGV[1] and returns 1, sets it again if it expired
+// and returns 2 or returns 0 if it's set to something else.
+var refreshScript = goredis.NewScript(`
+local value = redis.call("GET", KEYS[1])
+if value == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+if not value then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 2
+end
+return 0
+`)
+
+// deleteScript deletes the key KEYS[1] if it's still set to ARGV[1], so a
+// node never deletes a pool another node registered after its key expired.
+var deleteScript = goredis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// globEscaper escapes the characters special in SCAN MATCH patterns.
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
@@ -0,0 +1,124 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/discordianfish/infisk8-server/manager"
+	"github.com/go-kit/kit/log"
+)
+
+func TestRegistry(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.RequireAuth("secret")
+	server.Set("other:key", "unrelated")
+	r := NewRegistry(Config{Addr: server.Addr(), Password: "secret", Prefix: "test:*:"})
+	defer r.Close()
+
+	record := manager.PoolRecord{Node: "a", Config: manager.PoolConfig{Topology: manager.TopologyStar, MaxSessions: 4}}
+	for _, name := range []string{"foo", "bar"} {
+		if err := r.Register(name, record); err != nil {
+			t.Fatalf("Couldn't register %s: %s", name, err)
+		}
+	}
+	if err := r.Register("foo", record); !errors.Is(err, manager.ErrPoolExists) {
+		t.Errorf("Expected ErrPoolExists, got %v", err)
+	}
+
+	got, ok, err := r.Lookup("foo")
+	if err != nil || !ok || !reflect.DeepEqual(got, record) {
+		t.Errorf("Expected %+v, got %+v (ok=%t, err=%v)", record, got, ok, err)
+	}
+	if _, ok, err := r.Lookup("missing"); ok || err != nil {
+		t.Errorf("Expected missing pool not to be found, got ok=%t, err=%v", ok, err)
+	}
+
+	names, err := r.Pools()
+	if err != nil {
+		t.Fatalf("Couldn't list pools: %s", err)
+	}
+	if want := []string{"bar", "foo"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Expected pools %v, got %v", want, names)
+	}
+
+	if err := r.Deregister("foo"); err != nil {
+		t.Fatalf("Couldn't deregister: %s", err)
+	}
+	if _, ok, _ := r.Lookup("foo"); ok {
+		t.Error("Expected deregistered pool not to be found")
+	}
+}
+
+func TestRegistryAuthFailure(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.RequireAuth("secret")
+	r := NewRegistry(Config{Addr: server.Addr(), Password: "wrong"})
+	defer r.Close()
+	if _, _, err := r.Lookup("foo"); err == nil {
+		t.Error("Expected lookup with the wrong password to fail")
+	}
+}
+
+func TestRegistryTTL(t *testing.T) {
+	const ttl = time.Hour // Long enough for refresh not to run on its own
+	server := miniredis.RunT(t)
+	r := NewRegistry(Config{Addr: server.Addr(), TTL: ttl})
+	for _, name := range []string{"foo", "bar", "baz"} {
+		if err := r.Register(name, manager.PoolRecord{Node: "a"}); err != nil {
+			t.Fatalf("Couldn't register %s: %s", name, err)
+		}
+	}
+	if got := server.TTL(DefaultPrefix + "foo"); got != ttl {
+		t.Fatalf("Expected TTL %s, got %s", ttl, got)
+	}
+
+	server.FastForward(ttl / 2)
+	r.refresh()
+	if got := server.TTL(DefaultPrefix + "foo"); got != ttl {
+		t.Errorf("Expected refresh to reset the TTL to %s, got %s", ttl, got)
+	}
+
+	// Set again after expiring, unless another node took the pool over.
+	server.FastForward(ttl)
+	server.Set(DefaultPrefix+"bar", `{"node":"b"}`)
+	r.refresh()
+	if record, ok, err := r.Lookup("foo"); err != nil || !ok || record.Node != "a" {
+		t.Errorf("Expected expired pool to be registered again, got %+v (ok=%t, err=%v)", record, ok, err)
+	}
+	if record, ok, err := r.Lookup("bar"); err != nil || !ok || record.Node != "b" {
+		t.Errorf("Expected pool to stay with the other node, got %+v (ok=%t, err=%v)", record, ok, err)
+	}
+
+	if err := r.Deregister("baz"); err != nil {
+		t.Fatalf("Couldn't deregister: %s", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Couldn't close: %s", err)
+	}
+	if keys := server.Keys(); !reflect.DeepEqual(keys, []string{DefaultPrefix + "bar"}) {
+		t.Errorf("Expected Close to delete only the keys registered there, got %v", keys)
+	}
+}
+
+func TestManagerShutdownDeregisters(t *testing.T) {
+	server := miniredis.RunT(t)
+	r := NewRegistry(Config{Addr: server.Addr()})
+	defer r.Close()
+	m := manager.NewManager(log.NewNopLogger(), manager.WithPoolRegistry(r), manager.WithNodeID("a"))
+	if _, err := m.NewPool("foo", manager.PoolConfig{}); err != nil {
+		t.Fatalf("Couldn't create pool: %s", err)
+	}
+	if !server.Exists(DefaultPrefix + "foo") {
+		t.Fatal("Expected pool to be registered")
+	}
+	if err := m.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Couldn't shut down: %s", err)
+	}
+	if keys := server.Keys(); len(keys) != 0 {
+		t.Errorf("Expected shutdown to deregister all pools, got %v", keys)
+	}
+}
@@ -0,0 +1,71 @@
+// Package tracing configures OpenTelemetry to export spans of joins and
+// broadcasts via OTLP over HTTP.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// NewTracerProviderFromEnv returns a TracerProvider exporting spans via OTLP
+// over HTTP, configured by the standard OpenTelemetry environment variables
+// like OTEL_EXPORTER_OTLP_ENDPOINT, OTEL_EXPORTER_OTLP_HEADERS,
+// OTEL_SERVICE_NAME and OTEL_TRACES_SAMPLER. The service name defaults to
+// serviceName.
+//
+// If no endpoint is set, OTEL_SDK_DISABLED is true or OTEL_TRACES_EXPORTER is
+// none, it returns nil, which leaves tracing disabled.
+func NewTracerProviderFromEnv(ctx context.Context, serviceName string) (*sdktrace.TracerProvider, error) {
+	if disabled, _ := strconv.ParseBool(os.Getenv("OTEL_SDK_DISABLED")); disabled {
+		return nil, nil
+	}
+	if e := os.Getenv("OTEL_TRACES_EXPORTER"); e == "none" {
+		return nil, nil
+	} else if e != "" && e != "otlp" {
+		return nil, fmt.Errorf("Unsupported OTEL_TRACES_EXPORTER %q", e)
+	}
+	if os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" {
+		return nil, nil
+	}
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	if protocol != "" && protocol != "http/protobuf" {
+		return nil, fmt.Errorf("Unsupported OTLP protocol %q, only http/protobuf is supported", protocol)
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create OTLP exporter: %w", err)
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+		resource.WithFromEnv(), // Overrides the service name with OTEL_SERVICE_NAME
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't create resource: %w", err)
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	), nil
+}
+
+// SetError marks span as failed with err unless err is nil.
+func SetError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
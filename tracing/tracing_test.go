@@ -0,0 +1,60 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNewTracerProviderFromEnv(t *testing.T) {
+	var exports int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/v1/traces" && r.Header.Get("Content-Type") == "application/x-protobuf" {
+			atomic.AddInt32(&exports, 1)
+		}
+	}))
+	defer collector.Close()
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+
+	tp, err := NewTracerProviderFromEnv(context.Background(), "test")
+	if err != nil {
+		t.Fatalf("Couldn't create tracer provider: %s", err)
+	}
+	if tp == nil {
+		t.Fatal("Expected tracer provider with endpoint set")
+	}
+	_, span := tp.Tracer("test").Start(context.Background(), "test")
+	span.End()
+	if err := tp.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Couldn't export spans: %s", err)
+	}
+	if n := atomic.LoadInt32(&exports); n != 1 {
+		t.Errorf("Expected 1 export, got %d", n)
+	}
+}
+
+func TestNewTracerProviderFromEnvDisabled(t *testing.T) {
+	for name, env := range map[string]map[string]string{
+		"no endpoint": {},
+		"sdk disabled": {
+			"OTEL_EXPORTER_OTLP_ENDPOINT": "http://localhost:4318",
+			"OTEL_SDK_DISABLED":           "true",
+		},
+		"no exporter": {
+			"OTEL_EXPORTER_OTLP_ENDPOINT": "http://localhost:4318",
+			"OTEL_TRACES_EXPORTER":        "none",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for k, v := range env {
+				t.Setenv(k, v)
+			}
+			tp, err := NewTracerProviderFromEnv(context.Background(), "test")
+			if err != nil || tp != nil {
+				t.Errorf("Expected tracing to be disabled, got %v (err=%v)", tp, err)
+			}
+		})
+	}
+}